@@ -7,6 +7,13 @@ import (
 	"testing"
 )
 
+// TestMain runs the tests as outside of sshd, the subcommands are not run under sshd
+func TestMain(m *testing.M) {
+	os.Unsetenv("SSH_CONNECTION")
+	os.Unsetenv("SSH_CLIENT")
+	os.Exit(m.Run())
+}
+
 func TestAuthCmd(t *testing.T) {
 	tt := []struct {
 		name       string
@@ -16,22 +23,23 @@ func TestAuthCmd(t *testing.T) {
 		want       string
 		wantRegex  string
 		exitCode   int
+		userAuth   string
 	}{
 		{
 			name:       "empty command",
 			command:    "",
 			mainArgs:   []string{"test1"},
 			configFile: "tests/authcmd_test.yml",
-			want:       "Denied : direct ssh not allowed, you must specify a command",
-			exitCode:   1,
+			want:       "Denied (NO_COMMAND) : direct ssh not allowed, you must specify a command",
+			exitCode:   126,
 		},
 		{
 			name:       "forbidden command",
 			command:    "rm",
 			mainArgs:   []string{"test1"},
 			configFile: "tests/authcmd_test.yml",
-			want:       "Denied : command `rm` not allowed",
-			exitCode:   1,
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `rm` not allowed",
+			exitCode:   127,
 		},
 		{
 			name:       "working command",
@@ -63,7 +71,7 @@ func TestAuthCmd(t *testing.T) {
 			mainArgs:   []string{"test2"},
 			configFile: "tests/authcmd_test.yml",
 			want:       "Denied",
-			exitCode:   1,
+			exitCode:   127,
 		},
 		{
 			name:       "allowed cmd output",
@@ -71,7 +79,7 @@ func TestAuthCmd(t *testing.T) {
 			mainArgs:   []string{"test3"},
 			configFile: "tests/authcmd_test.yml",
 			want:       "Allowed : ls,id",
-			exitCode:   1,
+			exitCode:   127,
 		},
 		{
 			name:       "exit code",
@@ -85,8 +93,8 @@ func TestAuthCmd(t *testing.T) {
 			command:    "/bin/echo iwant $MY_SECRET",
 			mainArgs:   []string{"test1"},
 			configFile: "tests/authcmd_test.yml",
-			want:       "Denied : command `/bin/echo` argument : `$MY_SECRET` forbidden : regex `\\$`",
-			exitCode:   1,
+			want:       "Denied (ARG_FORBIDDEN) : command `/bin/echo` argument : `$MY_SECRET` forbidden : regex `\\$`",
+			exitCode:   126,
 		},
 		{
 			name:       "allowed arg",
@@ -110,7 +118,7 @@ func TestAuthCmd(t *testing.T) {
 			mainArgs:   []string{"test4"},
 			configFile: "tests/authcmd_test.yml",
 			want:       "This is a helping text",
-			exitCode:   1,
+			exitCode:   127,
 		},
 		{
 			name:       "test expand",
@@ -157,16 +165,16 @@ func TestAuthCmd(t *testing.T) {
 			command:    "id",
 			configFile: "tests/authcmd_test.yml",
 			mainArgs:   []string{"doesnotexists"},
-			want:       "Denied : command `id` not allowed",
-			exitCode:   1,
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `id` not allowed",
+			exitCode:   127,
 		},
 		{
 			name:       "must match ko",
 			command:    "cat /etc/passwd",
 			configFile: "tests/authcmd_test.yml",
 			mainArgs:   []string{"test9"},
-			want:       "Denied : command `cat` arguments : ` /etc/passwd` not matching regex `.*LICENSE$`",
-			exitCode:   1,
+			want:       "Denied (MUST_MATCH_FAILED) : command `cat` arguments : ` /etc/passwd` not matching regex `.*LICENSE$`",
+			exitCode:   126,
 		},
 		{
 			name:       "must match ok",
@@ -200,11 +208,278 @@ func TestAuthCmd(t *testing.T) {
 			want:       "test11 global",
 			exitCode:   0,
 		},
+		{
+			name:       "learn mode",
+			command:    "echo learned",
+			mainArgs:   []string{"test12"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "learned",
+			exitCode:   0,
+		},
+		{
+			name:       "learn mode args",
+			command:    "ls -d tests",
+			mainArgs:   []string{"test12"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "tests",
+			exitCode:   0,
+		},
+		{
+			name:       "configured denied exit code",
+			command:    "rm",
+			mainArgs:   []string{"test13"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `rm` not allowed",
+			exitCode:   1,
+		},
+		{
+			name:       "configured reason exit code",
+			command:    "echo $HOME",
+			mainArgs:   []string{"test13"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (ARG_FORBIDDEN) : command `echo` argument : `$HOME` forbidden : regex `\\$`",
+			exitCode:   3,
+		},
+		{
+			name:       "denied template",
+			command:    "rm -rf /",
+			mainArgs:   []string{"test14"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "COMMAND_NOT_ALLOWED for rm with tags test14\nallowed : ls\ncontact ops@example.com",
+			exitCode:   127,
+		},
+		{
+			name:       "help",
+			command:    "authcmd-help",
+			mainArgs:   []string{"test15"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Allowed commands :\n  ls\n  /bin/echo  Print its arguments  echo [-n] <text>\nRun `authcmd-help <command>` for the examples of a command",
+			exitCode:   0,
+		},
+		{
+			name:       "help of a command",
+			command:    "help echo",
+			mainArgs:   []string{"test15"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Command : /bin/echo\nDescription : Print its arguments\nUsage : echo [-n] <text>\nExamples :\n  echo hello\n  echo -n hello",
+			exitCode:   0,
+		},
+		{
+			name:       "help of a command not allowed",
+			command:    "authcmd-help rm",
+			mainArgs:   []string{"test15"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "command `rm` not allowed, run `authcmd-help` for the allowed commands",
+			exitCode:   127,
+		},
+		{
+			name:       "help not enabled",
+			command:    "authcmd-help",
+			mainArgs:   []string{"test1"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `authcmd-help` not allowed",
+			exitCode:   127,
+		},
+		{
+			name:       "capabilities",
+			command:    "authcmd-capabilities --json",
+			mainArgs:   []string{"test16"},
+			configFile: "tests/authcmd_test.yml",
+			want: `{
+  "tags": [
+    "test16"
+  ],
+  "commands": [
+    {
+      "command": "ls",
+      "stdin": false
+    },
+    {
+      "command": "cat",
+      "description": "Print the files",
+      "stdin": true,
+      "args": {
+        "forbidden": [
+          "^/etc"
+        ]
+      },
+      "mustMatch": [
+        ".*LICENSE$"
+      ]
+    }
+  ]
+}`,
+			exitCode: 0,
+		},
+		{
+			name:       "capabilities with params",
+			command:    "authcmd-capabilities",
+			mainArgs:   []string{"test16", "test20", "project=shop"},
+			configFile: "tests/authcmd_test.yml",
+			want: `{
+  "tags": [
+    "test16",
+    "test20",
+    "project=shop"
+  ],
+  "commands": [
+    {
+      "command": "ls",
+      "stdin": false
+    },
+    {
+      "command": "cat",
+      "description": "Print the files",
+      "stdin": true,
+      "args": {
+        "forbidden": [
+          "^/etc"
+        ]
+      },
+      "mustMatch": [
+        ".*LICENSE$"
+      ]
+    },
+    {
+      "command": "/bin/echo",
+      "stdin": false,
+      "args": {
+        "allowed": [
+          "^/srv/shop/",
+          "^staging$"
+        ]
+      }
+    }
+  ]
+}`,
+			exitCode: 0,
+		},
+		{
+			name:       "capabilities not enabled",
+			command:    "authcmd-capabilities --json",
+			mainArgs:   []string{"test15"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `authcmd-capabilities` not allowed",
+			exitCode:   127,
+		},
+		{
+			name:       "removed cmd",
+			command:    "ls",
+			mainArgs:   []string{"test1", "test18"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `ls` not allowed",
+			exitCode:   127,
+		},
+		{
+			name:       "replaced cmd",
+			command:    "/bin/echo I love pizza",
+			mainArgs:   []string{"test1", "test18"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "I love pizza",
+			exitCode:   0,
+		},
+		{
+			name:       "extended profile and keyTag",
+			command:    "cat /etc/LICENSE",
+			mainArgs:   []string{"test19"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied",
+			exitCode:   126,
+		},
+		{
+			name:       "params",
+			command:    "/bin/echo /srv/shop/current staging",
+			mainArgs:   []string{"test20", "project=shop"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "/srv/shop/current staging",
+			exitCode:   0,
+		},
+		{
+			name:       "invalid param",
+			command:    "/bin/echo /srv/shop/current",
+			mainArgs:   []string{"test20", "project=sh.p"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (PARAM_INVALID) : param `project` value `sh.p` not allowed",
+			exitCode:   126,
+		},
+		{
+			name:       "variables",
+			command:    "/bin/echo /tmp/test21/work",
+			mainArgs:   []string{"test21"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "/tmp/test21/work",
+			exitCode:   0,
+		},
+		{
+			name:       "variables quoted",
+			command:    "/bin/echo /tmp/test2/work",
+			mainArgs:   []string{"test21"},
+			configFile: "tests/authcmd_test.yml",
+			want:       "Denied (ARG_NOT_ALLOWED) : command `/bin/echo` arguments : `/tmp/test2/work` not allowed",
+			exitCode:   126,
+		},
+		{
+			name:       "key tags",
+			command:    "/bin/echo /tmp/test21/work",
+			configFile: "tests/authcmd_test.yml",
+			userAuth:   "tests/ssh_user_auth",
+			want:       "/tmp/test21/work",
+			exitCode:   0,
+		},
+		{
+			name:       "key and argv tags",
+			command:    "/bin/echo /tmp/test21/work staging",
+			mainArgs:   []string{"test20", "project=shop"},
+			configFile: "tests/authcmd_test.yml",
+			userAuth:   "tests/ssh_user_auth",
+			want:       "/tmp/test21/work staging",
+			exitCode:   0,
+		},
+		{
+			name:       "certificate tags",
+			command:    "/bin/echo /tmp/test21/work",
+			configFile: "tests/authcmd_test.yml",
+			userAuth:   "tests/ssh_user_auth_cert",
+			want:       "/tmp/test21/work",
+			exitCode:   0,
+		},
+		{
+			name:       "expired certificate",
+			command:    "/bin/echo /tmp/test21/work",
+			configFile: "tests/authcmd_test.yml",
+			userAuth:   "tests/ssh_user_auth_expired",
+			want:       "Denied (COMMAND_NOT_ALLOWED) : command `/bin/echo` not allowed",
+			exitCode:   127,
+		},
+		{
+			name:       "json config",
+			command:    "/bin/echo I love pizza",
+			mainArgs:   []string{"test1"},
+			configFile: "tests/authcmd_test.json",
+			want:       "I love pasta",
+			exitCode:   0,
+		},
+		{
+			name:       "toml config",
+			command:    "/bin/echo $HOME",
+			mainArgs:   []string{"test1"},
+			configFile: "tests/authcmd_test.toml",
+			want:       "Denied (ARG_FORBIDDEN) : command `/bin/echo` argument : `$HOME` forbidden : regex `\\$`",
+			exitCode:   3,
+		},
+		{
+			name:       "invalid regex",
+			command:    "ls",
+			configFile: "tests/authcmd_invalid_regex_test.yml",
+			wantRegex:  "^Could not load config file : invalid config file .*keyTag `test1` command `/bin/echo` forbidden regex `\\(rm`",
+			exitCode:   79,
+		},
 	}
 	for _, tc := range tt {
 		t.Run(tc.name, func(t *testing.T) {
 			os.Setenv("SSH_ORIGINAL_COMMAND", tc.command)
 			os.Setenv("AUTHCMD_CONFIG_FILE", tc.configFile)
+			os.Setenv("SSH_USER_AUTH", tc.userAuth)
 			os.Args = append(os.Args[:1], tc.mainArgs...)
 			exitCode, out := handle()
 			//fmt.Println("out:", string(out))
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// capabilitiesCommand is the reserved command line printing the allowed commands as json when capabilities is set
+const capabilitiesCommand = "authcmd-capabilities"
+
+// capabilities is the json printed by capabilitiesCommand
+type capabilities struct {
+	Tags     []string             `json:"tags"`
+	Commands []*policy.Capability `json:"commands"`
+}
+
+// builtinCapabilities prints the allowed commands of the effective config as json
+// if the command line of the request is `authcmd-capabilities [--json]` and capabilities is set
+// It returns the exit code and the output, and false if the command is not the capabilities command
+func builtinCapabilities(p *policy.Policy, req policy.Request) (int, string, bool) {
+	parsed, err := policy.ParseCommandLine(req.Command)
+	if err != nil || len(parsed) == 0 || parsed[0] != capabilitiesCommand ||
+		len(parsed) > 2 || (len(parsed) == 2 && parsed[1] != "--json") {
+		return 0, "", false
+	}
+	config, err := p.Interpolated(req)
+	if err != nil {
+		return 0, "", false
+	}
+	commands := config.ListCapabilities()
+	if commands == nil {
+		return 0, "", false
+	}
+	setupLogging(config)
+	writeLog("CAPABILITIES - user `%s`%s original %q", req.Client.User, logTags(req.Tags), req.Command)
+	tags := req.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	data, err := json.MarshalIndent(&capabilities{Tags: tags, Commands: commands}, "", "  ")
+	if err != nil {
+		return config.ExitCode(policy.ExitInternalError), "", true
+	}
+	out := string(data) + "\n"
+	fmt.Print(out)
+	return 0, out, true
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// runCheck implements the check subcommand
+// It evaluates a command line as handle would for the given keyTags and ssh client, without running it,
+// and prints the decision, the matched allowed cmd, the final argv and the env vars set
+// With --explain, every step of the evaluation is printed before, as text or json
+// Exit code is exitOK if allowed, exitFailed if denied and exitConfigError if the config does not load
+func runCheck(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("check", stderr)
+	configFile := fs.String("config", "", "config file (default : same lookup as authcmd)")
+	var tags tagsFlag
+	fs.Var(&tags, "tags", "comma separated keyTags, as passed to authcmd in authorized_keys")
+	var client clientFlags
+	client.register(fs)
+	explain := fs.Bool("explain", false, "print every step of the evaluation")
+	jsonOutput := fs.Bool("json", false, "with --explain, print the trace as json")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	p, err := loadPolicy(*configFile)
+	var d *policy.Decision
+	if err == nil {
+		d, err = p.Evaluate(policy.Request{Command: strings.Join(fs.Args(), " "), Tags: tags, Env: os.Environ(), Client: client.client(), Trace: *explain})
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	switch {
+	case *explain && *jsonOutput:
+		fmt.Fprint(stdout, d.Trace.JSON())
+	case *explain:
+		fmt.Fprint(stdout, d.Trace.Text())
+		printDecision(stdout, d)
+	default:
+		printDecision(stdout, d)
+	}
+	if !d.Allowed {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// printDecision writes a human readable decision to w
+func printDecision(w io.Writer, d *policy.Decision) {
+	if d.Allowed {
+		fmt.Fprintln(w, "Decision : allowed")
+	} else {
+		fmt.Fprintln(w, "Decision : denied")
+		fmt.Fprintf(w, "Code : %s\n", d.Reason.Code)
+		fmt.Fprintf(w, "Reason : %s\n", d.Reason.Error())
+		fmt.Fprintf(w, "Exit code : %d\n", d.ExitCode())
+	}
+	if d.Cmd != nil {
+		fmt.Fprintf(w, "Allowed command : %s\n", d.Cmd.Command)
+	}
+	if !d.Allowed {
+		return
+	}
+	quoted := make([]string, 0, len(d.Argv))
+	for _, arg := range d.Argv {
+		quoted = append(quoted, fmt.Sprintf("%q", arg))
+	}
+	fmt.Fprintf(w, "Argv : %s\n", strings.Join(quoted, " "))
+	for _, kv := range d.Env {
+		fmt.Fprintf(w, "Env : %s\n", kv)
+	}
+}
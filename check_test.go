@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tt := []struct {
+		name      string
+		args      []string
+		wantRegex string
+		exitCode  int
+	}{
+		{
+			name:      "allowed",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test1", "--", "ls -l authcmd.go"},
+			wantRegex: "(?s)^Decision : allowed\nAllowed command : ls\nArgv : \"ls\" \"-l\" \"authcmd.go\"\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "replace and env",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test1,test10", "--", "/bin/echo I love pizza"},
+			wantRegex: "Argv : \"/bin/echo\" \"We\" \"love\" \"pasta\"\n",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "command env var",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test10", "--", "echo", "$MY_VAR"},
+			wantRegex: "Argv : \"echo\" \"test10\" \"echo\" \"cmd\"\nEnv : MY_VAR=test10 echo cmd\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "denied",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test1", "--", "/bin/echo $HOME"},
+			wantRegex: "(?s)^Decision : denied\nCode : ARG_FORBIDDEN\nReason : command `/bin/echo` argument : `\\$HOME` forbidden : regex `\\\\\\$`\nExit code : 126\nAllowed command : /bin/echo\n$",
+			exitCode:  exitFailed,
+		},
+		{
+			name:      "explain",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test1,nope", "--explain", "--", "ls -x"},
+			wantRegex: "(?s)^\\[tags\\] keyTag `test1` merged\n\\[tags\\] keyTag `nope` not found in config, ignored\n.*\\[match\\] `ls` compared by name with `ls` : match\n.*\\[args\\] argument `-x` allowed regex `\\.\\*go` : no match\n\\[decision\\] denied : command `ls` arguments : `-x` not allowed\nDecision : denied\n",
+			exitCode:  exitFailed,
+		},
+		{
+			name:      "explain json",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test1", "--explain", "--json", "--", "/bin/echo I love pizza"},
+			wantRegex: "(?s)^\\{\n  \"steps\": \\[\n.*\"step\": \"replace\",\n      \"message\": \"regex `I` by `We` : ` I love pizza` -> ` We love pizza`\".*\"step\": \"decision\"",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "current user",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test21", "--", "/bin/cat /home/" + currentUser() + "/notes"},
+			wantRegex: "^Decision : allowed\n",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "user",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test21", "--user", "alice", "--", "/bin/cat /home/alice/notes"},
+			wantRegex: "^Decision : allowed\n",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "client ip",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test21", "--client-ip", "10.1.2.3", "--", "/bin/ping 10.1.2.3"},
+			wantRegex: "^Decision : allowed\n",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "no client ip",
+			args:      []string{"--config", "tests/authcmd_test.yml", "--tags", "test21", "--", "/bin/ping 10.1.2.3"},
+			wantRegex: "^Decision : denied\nCode : PARAM_INVALID\nReason : command `/bin/ping` needs variable `SSH_CLIENT_IP`\n",
+			exitCode:  exitFailed,
+		},
+		{
+			name:      "config error",
+			args:      []string{"--config", "tests/authcmd_invalid_regex_test.yml", "--", "ls"},
+			wantRegex: "^Config error : invalid config file",
+			exitCode:  exitConfigError,
+		},
+		{
+			name:     "no command",
+			args:     []string{"--config", "tests/authcmd_test.yml"},
+			exitCode: exitUsage,
+		},
+	}
+	os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode, ran := runCommand(append([]string{"check"}, tc.args...), &stdout, &stderr)
+			if !ran {
+				t.Fatalf("check subcommand not run")
+			}
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d' with output '%s'", tc.exitCode, exitCode, stdout.String()+stderr.String())
+			}
+			if tc.wantRegex != "" && !regexp.MustCompile(tc.wantRegex).MatchString(stdout.String()) {
+				t.Errorf("Regex '%s' not matching, got '%s'", tc.wantRegex, stdout.String())
+			}
+		})
+	}
+
+	os.Setenv("SSH_ORIGINAL_COMMAND", "ls")
+	defer os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	if _, ran := runCommand([]string{"check", "--", "ls"}, &bytes.Buffer{}, &bytes.Buffer{}); ran {
+		t.Errorf("check subcommand must not run as a ssh forced command")
+	}
+}
+
+func TestCommandUnderSSHD(t *testing.T) {
+	// an interactive login has no SSH_ORIGINAL_COMMAND but SSH_CONNECTION and SSH_CLIENT
+	for _, name := range []string{"SSH_CONNECTION", "SSH_CLIENT"} {
+		os.Setenv(name, "192.0.2.1 52000 192.0.2.2 22")
+		if _, ran := runCommand([]string{"show", "--config", "tests/authcmd_test.yml"}, &bytes.Buffer{}, &bytes.Buffer{}); ran {
+			t.Errorf("show subcommand must not run with %s set", name)
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("SSH_CONNECTION", "192.0.2.1 52000 192.0.2.2 22")
+	defer os.Unsetenv("SSH_CONNECTION")
+	os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	os.Setenv("AUTHCMD_CONFIG_FILE", "tests/authcmd_test.yml")
+	os.Args = append(os.Args[:1], "show")
+	if exitCode, out := handle(); exitCode != 126 || !strings.Contains(out, "NO_COMMAND") {
+		t.Errorf("Want a login without command denied, got '%d' '%s'", exitCode, out)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// Exit codes of the authcmd subcommands
+const (
+	exitOK          = 0
+	exitFailed      = 1
+	exitConfigError = 2
+	exitUsage       = 3
+)
+
+// A command is an authcmd subcommand, used from a shell to work on a config
+// instead of as a ssh forced command
+type command struct {
+	usage string
+	run   func(args []string, stdout, stderr io.Writer) int
+}
+
+// commands holds the available subcommands by name
+// filled in init as the subcommands use it for their usage
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"check": {
+			usage: "check [--config file] [--tags tag1,tag2] [--user user] [--client-ip ip] -- \"command line\"",
+			run:   runCheck,
+		},
+		"test": {
+			usage: "test [--config file] [--user user] [--client-ip ip] policy_tests.yml",
+			run:   runTest,
+		},
+		"validate": {
+			usage: "validate [--config file]",
+			run:   runValidate,
+		},
+		"lint": {
+			usage: "lint [--config file] [--fail-on info|warning|error|none]",
+			run:   runLint,
+		},
+		"show": {
+			usage: "show [--config file] [--tags tag1,tag2 | --all-tags] [--format yaml|json]",
+			run:   runShow,
+		},
+		"diff": {
+			usage: "diff [--tags tag1,tag2] old.yml new.yml",
+			run:   runDiff,
+		},
+		"replay": {
+			usage: "replay --log authcmd.log [--config new.yml] [--client-ip ip]",
+			run:   runReplay,
+		},
+		"suggest": {
+			usage: "suggest --log authcmd.log [--generalize]",
+			run:   runSuggest,
+		},
+		"completion": {
+			usage: "completion [--config file] [--tags tag1,tag2] [--shell bash|zsh|fish] --ssh-target user@host",
+			run:   runCompletion,
+		},
+		"schema": {
+			usage: "schema",
+			run:   runSchema,
+		},
+	}
+}
+
+// sshEnvVars are set by sshd for every session, with or without a command
+var sshEnvVars = []string{"SSH_ORIGINAL_COMMAND", "SSH_CONNECTION", "SSH_CLIENT"}
+
+// runCommand runs the subcommand named by the first arg and returns its exit code
+// Subcommands are only looked for outside of sshd (none of sshEnvVars set), even for a login without command,
+// so a keyTag can never be shadowed by a subcommand name and a ssh client can never run a subcommand
+// The bool is false if no subcommand was run
+func runCommand(args []string, stdout, stderr io.Writer) (int, bool) {
+	for _, name := range sshEnvVars {
+		if _, underSSHD := os.LookupEnv(name); underSSHD {
+			return 0, false
+		}
+	}
+	if len(args) == 0 {
+		return 0, false
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		return 0, false
+	}
+	return c.run(args[1:], stdout, stderr), true
+}
+
+// newFlagSet returns a flag set for the named subcommand printing its usage on stderr
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage : authcmd %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// A tagsFlag is a flag.Value holding a list of keyTags
+// given as a comma separated list and/or by repeating the flag
+type tagsFlag []string
+
+// String returns the comma separated tags
+func (t *tagsFlag) String() string {
+	return strings.Join(*t, ",")
+}
+
+// Set appends the comma separated tags of value
+func (t *tagsFlag) Set(value string) error {
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// A clientFlags holds the --user and --client-ip flags, the ssh client of the commands evaluated by a subcommand
+type clientFlags struct {
+	user string
+	ip   string
+}
+
+// register adds the flags to fs
+func (c *clientFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.user, "user", "", "user running authcmd, the ${USER} variable (default : current user)")
+	fs.StringVar(&c.ip, "client-ip", "", "ip of the ssh client, the ${SSH_CLIENT_IP} variable")
+}
+
+// client returns the ssh client of the flags, the user is the current user if not set, as for authcmd run by sshd
+func (c *clientFlags) client() policy.Client {
+	client := policy.Client{User: c.user, IP: c.ip}
+	if client.User == "" {
+		client.User = currentUser()
+	}
+	return client
+}
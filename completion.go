@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"text/template"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// maxCompletionValues bounds the values derived from a single regex
+const maxCompletionValues = 50
+
+// safeWord matches the commands and values put in a completion script without quoting
+// `:` is left out as it separates the command from its description for zsh
+var safeWord = regexp.MustCompile(`^[A-Za-z0-9_.,/+=@%-]+$`)
+
+// A completionCmd is an allowed command offered by a completion script
+type completionCmd struct {
+	Command     string
+	Description string
+	// Values are offered as the arguments of the command
+	Values []string
+}
+
+// completionData is the data of the completion scripts
+type completionData struct {
+	// Name is the ssh target usable in a shell function name
+	Name   string
+	Target string
+	Tags   string
+	Cmds   []*completionCmd
+}
+
+// completionFuncs are the functions available in the completion scripts
+var completionFuncs = template.FuncMap{
+	"join":      strings.Join,
+	"quote":     shellQuote,
+	"fishQuote": fishQuote,
+}
+
+// completionScripts holds the completion script templates by shell
+var completionScripts = map[string]*template.Template{
+	"bash": template.Must(template.New("bash").Funcs(completionFuncs).Parse(bashCompletion)),
+	"zsh":  template.Must(template.New("zsh").Funcs(completionFuncs).Parse(zshCompletion)),
+	"fish": template.Must(template.New("fish").Funcs(completionFuncs).Parse(fishCompletion)),
+}
+
+// runCompletion implements the completion subcommand
+// It prints a client side completion script of `ssh target command args` for the allowed
+// commands of the keyTags, offering as arguments the completions of the allowed cmds
+// and the values of their allowed regex made of literals and alternations like `^(start|stop)$`
+// Exit code is exitOK, exitUsage on a wrong flag and exitConfigError if the config does not load
+func runCompletion(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("completion", stderr)
+	configFile := fs.String("config", "", "config file (default : same lookup as authcmd)")
+	var tags tagsFlag
+	fs.Var(&tags, "tags", "comma separated keyTags, as passed to authcmd in authorized_keys")
+	shell := fs.String("shell", "bash", "shell of the completion script : bash, zsh or fish")
+	target := fs.String("ssh-target", "", "ssh destination the script completes, as typed : user@host")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	script, ok := completionScripts[*shell]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown shell `%s`, must be bash, zsh or fish\n", *shell)
+		return exitUsage
+	}
+	if *target == "" || !safeWord.MatchString(*target) || fs.NArg() > 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	p, err := loadPolicy(*configFile)
+	var config *policy.Config
+	if err == nil {
+		config, err = p.Effective(tags)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	data := &completionData{
+		Name:   regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(*target, "_"),
+		Target: *target,
+		Tags:   tags.String(),
+		Cmds:   completionCmds(config),
+	}
+	if err := script.Execute(stdout, data); err != nil {
+		fmt.Fprintf(stderr, "Completion error : %s\n", err.Error())
+		return exitFailed
+	}
+	return exitOK
+}
+
+// completionCmds returns the allowed cmds of config with their values
+// commands and values needing quotes are left out, as are the values of a forbidden regex
+func completionCmds(config *policy.Config) []*completionCmd {
+	var cmds []*completionCmd
+	for _, allowedCmd := range config.AllowedCmd {
+		if !safeWord.MatchString(allowedCmd.Command) {
+			continue
+		}
+		c := &completionCmd{Command: allowedCmd.Command, Description: allowedCmd.Description}
+		candidates := append([]string{}, allowedCmd.Completions...)
+		var forbidden []*regexp.Regexp
+		if allowedCmd.Args != nil {
+			for _, allowed := range allowedCmd.Args.Allowed {
+				candidates = append(candidates, regexValues(allowed)...)
+			}
+			for _, pattern := range allowedCmd.Args.Forbidden {
+				if re, err := regexp.Compile(pattern); err == nil {
+					forbidden = append(forbidden, re)
+				}
+			}
+		}
+		seen := map[string]bool{}
+	candidates:
+		for _, value := range candidates {
+			if seen[value] || !safeWord.MatchString(value) {
+				continue
+			}
+			for _, re := range forbidden {
+				if re.MatchString(value) {
+					continue candidates
+				}
+			}
+			seen[value] = true
+			c.Values = append(c.Values, value)
+		}
+		cmds = append(cmds, c)
+	}
+	return cmds
+}
+
+// regexValues returns the strings matched by a regex made of literals, alternations,
+// small character classes and anchors only, like `^(start|stop)$` or `-[lt]`
+// nil is returned for any other regex
+func regexValues(pattern string) []string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return literalValues(re.Simplify())
+}
+
+// literalValues returns the strings matched by the parsed regex re, nil if not a finite list
+func literalValues(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpEmptyMatch, syntax.OpBeginText, syntax.OpEndText, syntax.OpBeginLine, syntax.OpEndLine:
+		return []string{""}
+	case syntax.OpCapture:
+		return literalValues(re.Sub[0])
+	case syntax.OpCharClass:
+		var values []string
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if int(re.Rune[i+1]-re.Rune[i])+len(values) >= maxCompletionValues {
+				return nil
+			}
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				values = append(values, string(r))
+			}
+		}
+		return values
+	case syntax.OpAlternate:
+		var values []string
+		for _, sub := range re.Sub {
+			subValues := literalValues(sub)
+			if subValues == nil || len(values)+len(subValues) > maxCompletionValues {
+				return nil
+			}
+			values = append(values, subValues...)
+		}
+		return values
+	case syntax.OpConcat:
+		values := []string{""}
+		for _, sub := range re.Sub {
+			subValues := literalValues(sub)
+			if subValues == nil || len(values)*len(subValues) > maxCompletionValues {
+				return nil
+			}
+			var product []string
+			for _, value := range values {
+				for _, subValue := range subValues {
+					product = append(product, value+subValue)
+				}
+			}
+			values = product
+		}
+		return values
+	}
+	return nil
+}
+
+// shellQuote returns s single quoted for bash and zsh
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// fishQuote returns s single quoted for fish
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+// bashCompletion completes `ssh target command args` from COMP_LINE
+// as COMP_WORDS splits user@host on the @ of COMP_WORDBREAKS
+// the previous completion of ssh is used for the other command lines
+const bashCompletion = `# bash completion of the commands allowed by authcmd on {{.Target}}{{with .Tags}} for the keyTags {{.}}{{end}}
+# generated by authcmd completion, source it from ~/.bashrc to complete ssh {{.Target}} <command> <argument>...
+_authcmd_{{.Name}}_fallback=
+if [[ $(complete -p ssh 2>/dev/null) =~ -F\ ([^ ]+) ]] && [[ ${BASH_REMATCH[1]} != _authcmd_{{.Name}} ]]; then
+    _authcmd_{{.Name}}_fallback=${BASH_REMATCH[1]}
+fi
+
+_authcmd_{{.Name}}() {
+    local line=${COMP_LINE:0:COMP_POINT} words i target=-1
+    read -ra words <<< "$line"
+    [[ -z $line || $line == *[[:space:]] ]] && words+=("")
+    for ((i = 1; i < ${#words[@]} - 1; i++)); do
+        if [[ ${words[i]} == {{.Target}} ]]; then
+            target=$i
+            break
+        fi
+    done
+    if ((target < 0)); then
+        if [[ -n $_authcmd_{{.Name}}_fallback ]]; then
+            "$_authcmd_{{.Name}}_fallback" "$@"
+        fi
+        return
+    fi
+    local cur=${words[${#words[@]}-1]}
+    if ((${#words[@]} - target == 2)); then
+        COMPREPLY=($(compgen -W '{{range .Cmds}}{{.Command}} {{end}}' -- "$cur"))
+    else
+        case ${words[target+1]#[\"\']} in
+{{- range .Cmds}}{{if .Values}}
+        {{.Command}}) COMPREPLY=($(compgen -W '{{join .Values " "}}' -- "$cur")) ;;
+{{- end}}{{end}}
+        esac
+    fi
+    # readline only replaces the part of the word after the last COMP_WORDBREAKS character
+    local prefix=${cur%"${cur##*[$COMP_WORDBREAKS]}"}
+    COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+}
+complete -F _authcmd_{{.Name}} ssh
+`
+
+// zshCompletion completes `ssh target command args`, calling _ssh for the other command lines
+const zshCompletion = `# zsh completion of the commands allowed by authcmd on {{.Target}}{{with .Tags}} for the keyTags {{.}}{{end}}
+# generated by authcmd completion, source it from ~/.zshrc after compinit to complete ssh {{.Target}} <command> <argument>...
+_authcmd_{{.Name}}() {
+    local i target=0
+    for ((i = 2; i < CURRENT; i++)); do
+        if [[ $words[i] == {{.Target}} ]]; then
+            target=$i
+            break
+        fi
+    done
+    if ((target == 0)); then
+        _ssh "$@"
+        return
+    fi
+    if ((CURRENT == target + 1)); then
+        local -a cmds
+        cmds=({{range .Cmds}}
+            {{if .Description}}{{quote (printf "%s:%s" .Command .Description)}}{{else}}{{.Command}}{{end}}{{end}}
+        )
+        _describe -t commands 'authcmd command' cmds
+        return
+    fi
+    case ${words[target+1]#[\"\']} in
+{{- range .Cmds}}{{if .Values}}
+    {{.Command}}) compadd -- {{join .Values " "}} ;;
+{{- end}}{{end}}
+    esac
+}
+compdef _authcmd_{{.Name}} ssh
+`
+
+// fishCompletion adds the completions of `ssh target command args` to the ones of ssh
+const fishCompletion = `# fish completion of the commands allowed by authcmd on {{.Target}}{{with .Tags}} for the keyTags {{.}}{{end}}
+# generated by authcmd completion, save it in ~/.config/fish/conf.d/ to complete ssh {{.Target}} <command> <argument>...
+function __authcmd_{{.Name}}_words
+    set -l tokens (commandline -opc)
+    set -l i (contains -i -- {{.Target}} $tokens); or return 1
+    set -e tokens[1..$i]
+    printf '%s\n' $tokens
+end
+{{range .Cmds}}
+complete -c ssh -n 'set -l w (__authcmd_{{$.Name}}_words); and test (count $w) -eq 0' -f -a {{.Command}}{{with .Description}} -d {{fishQuote .}}{{end}}
+{{- if .Values}}
+complete -c ssh -n 'set -l w (__authcmd_{{$.Name}}_words); and test "$w[1]" = {{.Command}}' -f -a '{{join .Values " "}}'
+{{- end}}
+{{- end}}
+`
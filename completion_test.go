@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRegexValues(t *testing.T) {
+	tt := []struct {
+		pattern string
+		want    []string
+	}{
+		{pattern: "-l", want: []string{"-l"}},
+		{pattern: "^(staging|production)$", want: []string{"staging", "production"}},
+		{pattern: "stag(ing|e)", want: []string{"staging", "stage"}},
+		{pattern: "-[vq]", want: []string{"-q", "-v"}},
+		{pattern: ".*go"},
+		{pattern: "[a-z]+"},
+		{pattern: "(?i)yes"},
+		{pattern: "[0-9][0-9]"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if got := regexValues(tc.pattern); strings.Join(got, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("Want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	tt := []struct {
+		name      string
+		args      []string
+		wantRegex string
+		exitCode  int
+	}{
+		{
+			name:      "bash",
+			args:      []string{"--tags", "test17", "--ssh-target", "deploy@host.example"},
+			wantRegex: "(?s)compgen -W 'ls deploy-app ' .*deploy-app\\) COMPREPLY=\\(\\$\\(compgen -W '--dry-run --env=staging staging production --force -q -v' .*complete -F _authcmd_deploy_host_example ssh\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "zsh",
+			args:      []string{"--tags", "test17", "--shell", "zsh", "--ssh-target", "deploy@host.example"},
+			wantRegex: "(?s)'deploy-app:Deploy the app'.*deploy-app\\) compadd -- --dry-run --env=staging staging production --force -q -v ;;.*compdef _authcmd_deploy_host_example ssh\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name:      "fish",
+			args:      []string{"--tags", "test17", "--shell", "fish", "--ssh-target", "deploy@host.example"},
+			wantRegex: "-f -a deploy-app -d 'Deploy the app'\ncomplete -c ssh -n 'set -l w \\(__authcmd_deploy_host_example_words\\); and test \"\\$w\\[1\\]\" = deploy-app' -f -a '--dry-run --env=staging staging production --force -q -v'\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name:     "unknown shell",
+			args:     []string{"--shell", "csh", "--ssh-target", "deploy@host.example"},
+			exitCode: exitUsage,
+		},
+		{
+			name:     "no ssh target",
+			args:     []string{"--tags", "test17"},
+			exitCode: exitUsage,
+		},
+	}
+	os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode, _ := runCommand(append([]string{"completion", "--config", "tests/authcmd_test.yml"}, tc.args...), &stdout, &stderr)
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d' with output '%s'", tc.exitCode, exitCode, stdout.String()+stderr.String())
+			}
+			if tc.wantRegex != "" && !regexp.MustCompile(tc.wantRegex).MatchString(stdout.String()) {
+				t.Errorf("Regex '%s' not matching, got '%s'", tc.wantRegex, stdout.String())
+			}
+		})
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not found")
+	}
+	var stdout bytes.Buffer
+	if exitCode, _ := runCommand([]string{"completion", "--config", "tests/authcmd_test.yml", "--tags", "test17", "--ssh-target", "deploy@host.example"}, &stdout, &bytes.Buffer{}); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d'", exitOK, exitCode)
+	}
+	script := filepath.Join(t.TempDir(), "authcmd.bash")
+	if err := ioutil.WriteFile(script, stdout.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tt := map[string]string{
+		"ssh deploy@host.example ":                    "ls deploy-app",
+		"ssh deploy@host.example dep":                 "deploy-app",
+		"ssh -p 22 deploy@host.example deploy-app st": "staging",
+		"ssh deploy@host.example deploy-app --env=st": "staging",
+		"ssh deploy@host.example ls -":                "",
+		"ssh other.example ":                          "",
+	}
+	for line, want := range tt {
+		out, err := exec.Command("bash", "-c", `source "$1"; COMP_LINE=$2; COMP_POINT=${#2}; _authcmd_deploy_host_example; echo "${COMPREPLY[*]}"`, "bash", script, line).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s : %s", err, out)
+		}
+		if got := strings.TrimSpace(string(out)); got != want {
+			t.Errorf("Want completion of '%s' '%s', got '%s'", line, want, got)
+		}
+	}
+}
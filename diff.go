@@ -0,0 +1,467 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/sorted"
+	"github.com/dranih/authcmd/policy"
+)
+
+// Kinds of a policy change
+const (
+	changeExpanding = iota
+	changeRestricting
+	changeOther
+)
+
+// changeTitles holds the titles of the kinds of change in the diff output
+var changeTitles = []string{"Privilege expanding", "Restricting", "Other"}
+
+// A policyChange is a difference of access between two effective policies
+type policyChange struct {
+	kind int
+	msg  string
+}
+
+// A policyDiff collects the changes between two effective policies
+type policyDiff struct {
+	changes []policyChange
+}
+
+// add records a change
+func (d *policyDiff) add(kind int, msg string, args ...interface{}) {
+	d.changes = append(d.changes, policyChange{kind: kind, msg: fmt.Sprintf(msg, args...)})
+}
+
+// diffPolicies returns the changes of access from the before to the after merged config
+func diffPolicies(before *policy.Config, after *policy.Config) []policyChange {
+	d := &policyDiff{}
+	// enabling an output shows more to the user, except terse output which hides the details
+	d.diffBool("showAllowed", before.ShowAllowed, after.ShowAllowed, changeExpanding)
+	d.diffBool("showDenied", before.ShowDenied, after.ShowDenied, changeExpanding)
+	d.diffBool("showTerseDenied", before.ShowTerseDenied, after.ShowTerseDenied, changeRestricting)
+	d.diffBool("expandEnvVars", before.ExpandEnvVars, after.ExpandEnvVars, changeExpanding)
+	d.diffBool("enableHelp", before.EnableHelp, after.EnableHelp, changeExpanding)
+	d.diffBool("enableLogging", before.EnableLogging, after.EnableLogging, changeOther)
+	d.diffString("logDecisions", before.LogDecisions, after.LogDecisions)
+	if before.DeniedTemplate != after.DeniedTemplate {
+		d.add(changeOther, "deniedTemplate changed")
+	}
+	// learn mode runs the denied commands
+	if oldLearn, newLearn := before.Mode == "learn", after.Mode == "learn"; newLearn && !oldLearn {
+		d.add(changeExpanding, "mode learn enabled, denied commands are run")
+	} else if oldLearn && !newLearn {
+		d.add(changeRestricting, "mode learn disabled, denied commands are no longer run")
+	}
+	switch {
+	case before.UseShell == after.UseShell:
+	case before.UseShell == "":
+		d.add(changeExpanding, "commands run with shell `%s`", after.UseShell)
+	case after.UseShell == "":
+		d.add(changeRestricting, "commands no longer run with shell `%s`", before.UseShell)
+	default:
+		d.add(changeOther, "shell changed from `%s` to `%s`", before.UseShell, after.UseShell)
+	}
+	// args reveals the argument regex on top of the commands
+	switch {
+	case before.Capabilities == after.Capabilities:
+	case before.Capabilities == "":
+		d.add(changeExpanding, "capabilities `%s` enabled", after.Capabilities)
+	case after.Capabilities == "":
+		d.add(changeRestricting, "capabilities `%s` disabled", before.Capabilities)
+	case after.Capabilities == policy.CapabilitiesArgs:
+		d.add(changeExpanding, "capabilities changed from `%s` to `%s`", before.Capabilities, after.Capabilities)
+	default:
+		d.add(changeRestricting, "capabilities changed from `%s` to `%s`", before.Capabilities, after.Capabilities)
+	}
+	d.diffValues("", "env var", before.SetEnvVars, after.SetEnvVars)
+	d.diffValues("", "variable", before.Variables, after.Variables)
+	for _, name := range paramNames(before.Params, after.Params) {
+		d.diffParam(name, before.Params[name], after.Params[name])
+	}
+	for _, key := range exitCodeKeys(before.ExitCodes, after.ExitCodes) {
+		if oldCode, newCode := before.ExitCode(key), after.ExitCode(key); oldCode != newCode {
+			d.add(changeOther, "exit code `%s` changed from %d to %d", key, oldCode, newCode)
+		}
+	}
+
+	oldCmds := map[string]*policy.Cmd{}
+	for _, c := range before.AllowedCmd {
+		oldCmds[c.Command] = c
+	}
+	newCmds := map[string]*policy.Cmd{}
+	for _, c := range after.AllowedCmd {
+		newCmds[c.Command] = c
+		if _, exists := oldCmds[c.Command]; !exists {
+			d.add(changeExpanding, "command `%s` added", c.Command)
+		}
+	}
+	for _, c := range before.AllowedCmd {
+		newCmd, exists := newCmds[c.Command]
+		if !exists {
+			d.add(changeRestricting, "command `%s` removed", c.Command)
+			continue
+		}
+		d.diffCmd(c, newCmd)
+	}
+	return d.changes
+}
+
+// exitCodeKeys returns the sorted keys set in any of the exitCodes configs
+func exitCodeKeys(before map[string]int, after map[string]int) []string {
+	keys := map[string]string{}
+	for key := range before {
+		keys[key] = ""
+	}
+	for key := range after {
+		keys[key] = ""
+	}
+	return sorted.Keys(keys)
+}
+
+// paramNames returns the sorted names of the params declared in any of the params configs
+func paramNames(before map[string]*policy.Param, after map[string]*policy.Param) []string {
+	names := map[string]string{}
+	for name := range before {
+		names[name] = ""
+	}
+	for name := range after {
+		names[name] = ""
+	}
+	return sorted.Keys(names)
+}
+
+// diffParam records the changes of a param, nil if not declared
+// a param accepting more values expands the commands a key can run with its `key=value` tags
+func (d *policyDiff) diffParam(name string, before *policy.Param, after *policy.Param) {
+	switch {
+	case before == nil && after == nil:
+		return
+	case before == nil:
+		d.add(changeExpanding, "param `%s` added", name)
+		return
+	case after == nil:
+		d.add(changeRestricting, "param `%s` removed", name)
+		return
+	}
+	scope := fmt.Sprintf("param `%s` : ", name)
+	added, removed := diffLists(before.Values, after.Values)
+	for _, value := range added {
+		d.add(changeExpanding, "%svalue `%s` added", scope, value)
+	}
+	for _, value := range removed {
+		d.add(changeRestricting, "%svalue `%s` removed", scope, value)
+	}
+	switch {
+	case before.Pattern == after.Pattern:
+	case before.Pattern == "":
+		d.add(changeExpanding, "%spattern `%s` added", scope, after.Pattern)
+	case after.Pattern == "":
+		d.add(changeRestricting, "%spattern `%s` removed", scope, before.Pattern)
+	default:
+		d.add(changeOther, "%spattern changed from `%s` to `%s`", scope, before.Pattern, after.Pattern)
+	}
+	if before.Default != after.Default {
+		d.add(changeOther, "%sdefault changed from `%s` to `%s`", scope, before.Default, after.Default)
+	}
+}
+
+// diffBool records the change of a *bool option, whose enabling is of kind enabled
+// disabling it is of the opposite kind, or other
+func (d *policyDiff) diffBool(name string, before *bool, after *bool, enabled int) {
+	oldValue, newValue := before != nil && *before, after != nil && *after
+	if oldValue == newValue {
+		return
+	}
+	disabled := changeOther
+	switch enabled {
+	case changeExpanding:
+		disabled = changeRestricting
+	case changeRestricting:
+		disabled = changeExpanding
+	}
+	if newValue {
+		d.add(enabled, "%s enabled", name)
+	} else {
+		d.add(disabled, "%s disabled", name)
+	}
+}
+
+// diffString records the change of a string option
+func (d *policyDiff) diffString(name string, before string, after string) {
+	switch {
+	case before == after:
+	case before == "":
+		d.add(changeOther, "%s set to `%s`", name, after)
+	case after == "":
+		d.add(changeOther, "%s `%s` no longer set", name, before)
+	default:
+		d.add(changeOther, "%s changed from `%s` to `%s`", name, before, after)
+	}
+}
+
+// diffGrants returns the changes of the keyTags granted by the keys and certificate rules of the loaded configs,
+// which are not part of the effective configs, limited to the keyTags of tags if not empty
+// a keyTag granted to a key or certificate expands its access
+func diffGrants(before *policy.Config, after *policy.Config, tags []string) []policyChange {
+	d := &policyDiff{}
+	inScope := map[string]bool{}
+	for _, tag := range tags {
+		inScope[tag] = true
+	}
+	oldGrants, newGrants := grants(before), grants(after)
+	for _, grantee := range sortedGrantees(oldGrants, newGrants) {
+		added, removed := diffLists(oldGrants[grantee], newGrants[grantee])
+		for _, tag := range added {
+			if len(tags) == 0 || inScope[tag] {
+				d.add(changeExpanding, "%s : keyTag `%s` granted", grantee, tag)
+			}
+		}
+		for _, tag := range removed {
+			if len(tags) == 0 || inScope[tag] {
+				d.add(changeRestricting, "%s : keyTag `%s` no longer granted", grantee, tag)
+			}
+		}
+		addedOptions, removedOptions := diffLists(oldGrants[grantee+optionGrant], newGrants[grantee+optionGrant])
+		for _, option := range addedOptions {
+			d.add(changeExpanding, "%s : keyTags of option `%s` granted", grantee, option)
+		}
+		for _, option := range removedOptions {
+			d.add(changeRestricting, "%s : keyTags of option `%s` no longer granted", grantee, option)
+		}
+	}
+	return d.changes
+}
+
+// optionGrant suffixes a grantee in the grants to hold the options whose values are keyTags
+const optionGrant = "\x00option"
+
+// grants returns the keyTags granted by each key, by its fingerprint, and each certificate rule of the config
+func grants(config *policy.Config) map[string][]string {
+	granted := map[string][]string{}
+	for _, key := range config.Keys {
+		fingerprint, err := key.Fingerprint()
+		if err != nil {
+			fingerprint = key.Key
+		}
+		grantee := fmt.Sprintf("key `%s`", fingerprint)
+		granted[grantee] = append(granted[grantee], key.Tags...)
+	}
+	for _, rule := range config.Certificates {
+		grantee := fmt.Sprintf("certificates of ca `%s`", rule.CA)
+		if rule.Principal != "" {
+			grantee += fmt.Sprintf(" principal `%s`", rule.Principal)
+		}
+		if rule.KeyID != "" {
+			grantee += fmt.Sprintf(" keyId `%s`", rule.KeyID)
+		}
+		granted[grantee] = append(granted[grantee], rule.Tags...)
+		if rule.Option != "" {
+			granted[grantee+optionGrant] = append(granted[grantee+optionGrant], rule.Option)
+		}
+	}
+	return granted
+}
+
+// sortedGrantees returns the sorted keys and certificate rules of any of the grants, without the options
+func sortedGrantees(before map[string][]string, after map[string][]string) []string {
+	grantees := map[string]string{}
+	for _, granted := range []map[string][]string{before, after} {
+		for grantee := range granted {
+			grantees[strings.TrimSuffix(grantee, optionGrant)] = ""
+		}
+	}
+	return sorted.Keys(grantees)
+}
+
+// diffValues records the changes of the env vars or variables named by what, scope is empty for global ones
+func (d *policyDiff) diffValues(scope string, what string, before map[string]string, after map[string]string) {
+	for _, key := range sorted.Keys(after) {
+		if oldValue, exists := before[key]; !exists {
+			d.add(changeOther, "%s%s `%s` set to `%s`", scope, what, key, after[key])
+		} else if oldValue != after[key] {
+			d.add(changeOther, "%s%s `%s` changed from `%s` to `%s`", scope, what, key, oldValue, after[key])
+		}
+	}
+	for _, key := range sorted.Keys(before) {
+		if _, exists := after[key]; !exists {
+			d.add(changeOther, "%s%s `%s` no longer set", scope, what, key)
+		}
+	}
+}
+
+// diffCmd records the changes of the args, mustMatch, replace, env vars and stdin of an allowed cmd
+func (d *policyDiff) diffCmd(before *policy.Cmd, after *policy.Cmd) {
+	scope := fmt.Sprintf("command `%s` : ", before.Command)
+	d.diffBool(scope+"stdin", before.Stdin, after.Stdin, changeExpanding)
+	oldArgs, newArgs := before.Args, after.Args
+	if oldArgs == nil {
+		oldArgs = &policy.Args{}
+	}
+	if newArgs == nil {
+		newArgs = &policy.Args{}
+	}
+
+	// a nil allowed list allows any argument
+	switch {
+	case oldArgs.Allowed == nil && newArgs.Allowed != nil:
+		d.add(changeRestricting, "%sarguments restricted to allowed regex %q", scope, newArgs.Allowed)
+	case oldArgs.Allowed != nil && newArgs.Allowed == nil:
+		d.add(changeExpanding, "%sany argument allowed, was restricted to allowed regex %q", scope, oldArgs.Allowed)
+	default:
+		added, removed := diffLists(oldArgs.Allowed, newArgs.Allowed)
+		for _, pattern := range added {
+			d.add(changeExpanding, "%sallowed regex `%s` added", scope, pattern)
+		}
+		for _, pattern := range removed {
+			d.add(changeRestricting, "%sallowed regex `%s` removed", scope, pattern)
+		}
+	}
+	added, removed := diffLists(oldArgs.Forbidden, newArgs.Forbidden)
+	for _, pattern := range added {
+		d.add(changeRestricting, "%sforbidden regex `%s` added", scope, pattern)
+	}
+	for _, pattern := range removed {
+		d.add(changeExpanding, "%sforbidden regex `%s` removed", scope, pattern)
+	}
+	added, removed = diffLists(before.MustMatch, after.MustMatch)
+	for _, pattern := range added {
+		d.add(changeRestricting, "%smustMatch regex `%s` added", scope, pattern)
+	}
+	for _, pattern := range removed {
+		d.add(changeExpanding, "%smustMatch regex `%s` removed", scope, pattern)
+	}
+	for _, search := range sorted.Keys(after.Replace) {
+		if replace, exists := before.Replace[search]; !exists || replace != after.Replace[search] {
+			d.add(changeOther, "%sreplace regex `%s` by `%s`", scope, search, after.Replace[search])
+		}
+	}
+	for _, search := range sorted.Keys(before.Replace) {
+		if _, exists := after.Replace[search]; !exists {
+			d.add(changeOther, "%sreplace regex `%s` removed", scope, search)
+		}
+	}
+	d.diffValues(scope, "env var", before.SetEnvVars, after.SetEnvVars)
+}
+
+// diffLists returns the values of after not in before and the values of before not in after
+func diffLists(before []string, after []string) ([]string, []string) {
+	inOld, inNew := map[string]bool{}, map[string]bool{}
+	for _, value := range before {
+		inOld[value] = true
+	}
+	for _, value := range after {
+		inNew[value] = true
+	}
+	var added, removed []string
+	for _, value := range after {
+		if !inOld[value] {
+			added = append(added, value)
+		}
+	}
+	for _, value := range before {
+		if !inNew[value] {
+			removed = append(removed, value)
+		}
+	}
+	return added, removed
+}
+
+// runDiff implements the diff subcommand
+// It compares the effective policies of two config files, for the given keyTags
+// or without keyTags and for every keyTag of both files, and the keyTags granted by their keys and certificates
+// Exit code is exitOK if the access is the same, exitFailed if it changed
+func runDiff(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("diff", stderr)
+	var tags tagsFlag
+	fs.Var(&tags, "tags", "comma separated keyTags to compare (default : base and each keyTag)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitUsage
+	}
+	oldFile, newFile := fs.Arg(0), fs.Arg(1)
+
+	oldPolicy, err := policy.LoadFormat(oldFile, configFormat(oldFile))
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	newPolicy, err := policy.LoadFormat(newFile, configFormat(newFile))
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+
+	scopes := [][]string{tags}
+	if len(tags) == 0 {
+		allTags := map[string]bool{}
+		for _, p := range []*policy.Policy{oldPolicy, newPolicy} {
+			for _, tag := range p.Base().Tags() {
+				allTags[tag] = true
+			}
+		}
+		sorted := make([]string, 0, len(allTags))
+		for tag := range allTags {
+			sorted = append(sorted, tag)
+		}
+		sort.Strings(sorted)
+		for _, tag := range sorted {
+			scopes = append(scopes, []string{tag})
+		}
+	}
+
+	ret := exitOK
+	// the keys and certificates are not part of the effective configs
+	if changes := diffGrants(oldPolicy.Base(), newPolicy.Base(), tags); len(changes) > 0 {
+		ret = exitFailed
+		fmt.Fprintln(stdout, "== keys and certificates ==")
+		printChanges(stdout, changes)
+	}
+	for _, scope := range scopes {
+		oldConfig, err := oldPolicy.Effective(scope)
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		newConfig, err := newPolicy.Effective(scope)
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		changes := diffPolicies(oldConfig, newConfig)
+		if len(changes) == 0 {
+			continue
+		}
+		ret = exitFailed
+		if len(scope) == 0 {
+			fmt.Fprintln(stdout, "== base ==")
+		} else {
+			fmt.Fprintf(stdout, "== keyTags `%s` ==\n", strings.Join(scope, ","))
+		}
+		printChanges(stdout, changes)
+	}
+	return ret
+}
+
+// printChanges prints the changes grouped by kind
+func printChanges(stdout io.Writer, changes []policyChange) {
+	for kind, title := range changeTitles {
+		printed := false
+		for _, change := range changes {
+			if change.kind != kind {
+				continue
+			}
+			if !printed {
+				fmt.Fprintf(stdout, "%s :\n", title)
+				printed = true
+			}
+			fmt.Fprintf(stdout, "  %s\n", change.msg)
+		}
+	}
+}
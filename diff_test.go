@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	base := `Privilege expanding :
+  showAllowed enabled
+  enableHelp enabled
+  mode learn enabled, denied commands are run
+  commands run with shell ` + "`sh`" + `
+  capabilities changed from ` + "`commands`" + ` to ` + "`args`" + `
+  param ` + "`env`" + ` : value ` + "`production`" + ` added
+  param ` + "`region`" + ` added
+  command ` + "`/bin/rm`" + ` added
+%s  command ` + "`/bin/ls`" + ` : stdin enabled
+  command ` + "`/bin/ls`" + ` : allowed regex ` + "`^-a$`" + ` added
+%sRestricting :
+  showDenied disabled
+  command ` + "`/bin/cat`" + ` removed
+Other :
+  enableLogging disabled
+  logDecisions set to ` + "`trace`" + `
+  deniedTemplate changed
+  env var ` + "`LANG`" + ` set to ` + "`C`" + `
+  variable ` + "`logs`" + ` changed from ` + "`/var/log`" + ` to ` + "`/srv/log`" + `
+  param ` + "`env`" + ` : default changed from ` + "``" + ` to ` + "`staging`" + `
+`
+	cert := "certificates of ca `SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM`"
+	option := "  " + cert + " : keyTags of option `authcmd-roles@example.com` granted\n"
+	grants := "== keys and certificates ==\nPrivilege expanding :\n" + option +
+		"  key `SHA256:TSFUqbjPkPG+EFgnDrOxNVBBxSmQ8kReIFleByOPHco` : keyTag `dev` granted\n" +
+		"Restricting :\n  " + cert + " principal `^alice$` : keyTag `dev` no longer granted\n"
+	tt := []struct {
+		name     string
+		args     []string
+		want     string
+		exitCode int
+	}{
+		{
+			name: "all tags",
+			args: []string{"tests/authcmd_diff_old_test.yml", "tests/authcmd_diff_new_test.yml"},
+			want: grants + "== base ==\n" + fmt.Sprintf(base, "", "") +
+				"== keyTags `dev` ==\n" + fmt.Sprintf(base, "  command `/bin/id` added\n", "") +
+				"== keyTags `ops` ==\n" + fmt.Sprintf(base, "", "  command `/bin/echo` : forbidden regex `\\$` removed\n"),
+			exitCode: exitFailed,
+		},
+		{
+			name:     "tags",
+			args:     []string{"--tags", "ops", "tests/authcmd_diff_old_test.yml", "tests/authcmd_diff_new_test.yml"},
+			want:     "== keys and certificates ==\nPrivilege expanding :\n" + option + "== keyTags `ops` ==\n" + fmt.Sprintf(base, "", "  command `/bin/echo` : forbidden regex `\\$` removed\n"),
+			exitCode: exitFailed,
+		},
+		{
+			name:     "same",
+			args:     []string{"tests/authcmd_test.yml", "tests/authcmd_test.yml"},
+			exitCode: exitOK,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runDiff(tc.args, &stdout, &stderr)
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d'", tc.exitCode, exitCode)
+			}
+			if stdout.String() != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, stdout.String())
+			}
+		})
+	}
+}
@@ -3,5 +3,9 @@ module github.com/dranih/authcmd
 go 1.17
 
 require (
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
+	github.com/pelletier/go-toml/v2 v2.2.2
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
+
+require golang.org/x/sys v0.13.0 // indirect
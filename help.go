@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// helpCommand is the reserved command line printing the allowed commands when enableHelp is set
+// help is also reserved, unless it is an allowed command
+const helpCommand = "authcmd-help"
+
+// builtinHelp prints the help of the allowed commands of the effective config
+// if the command line of the request is a help command and enableHelp is set
+// It returns the exit code and the output, and false if the command is not a help command
+func builtinHelp(p *policy.Policy, req policy.Request) (int, string, bool) {
+	parsed, err := policy.ParseCommandLine(req.Command)
+	if err != nil || len(parsed) == 0 || len(parsed) > 2 {
+		return 0, "", false
+	}
+	config, err := p.Interpolated(req)
+	if err != nil || config.EnableHelp == nil || !*config.EnableHelp {
+		return 0, "", false
+	}
+	if parsed[0] != helpCommand && (parsed[0] != "help" || findCmd(config, "help") != nil) {
+		return 0, "", false
+	}
+	setupLogging(config)
+	writeLog("HELP - user `%s`%s original %q", req.Client.User, logTags(req.Tags), req.Command)
+	out, found := helpText(config, parsed[1:])
+	fmt.Print(out)
+	if !found {
+		return config.ExitCode(string(policy.CommandNotAllowed)), out, true
+	}
+	return 0, out, true
+}
+
+// helpText returns the table of the allowed commands of config, or the detail of the command in args
+// it returns false if the command in args is not allowed
+func helpText(config *policy.Config, args []string) (string, bool) {
+	var sb strings.Builder
+	if len(args) == 1 {
+		c := findCmd(config, args[0])
+		if c == nil {
+			fmt.Fprintf(&sb, "command `%s` not allowed, run `%s` for the allowed commands\n", args[0], helpCommand)
+			return sb.String(), false
+		}
+		fmt.Fprintf(&sb, "Command : %s\n", c.Command)
+		if c.Description != "" {
+			fmt.Fprintf(&sb, "Description : %s\n", c.Description)
+		}
+		if c.Usage != "" {
+			fmt.Fprintf(&sb, "Usage : %s\n", c.Usage)
+		}
+		if len(c.Examples) > 0 {
+			fmt.Fprintln(&sb, "Examples :")
+			for _, example := range c.Examples {
+				fmt.Fprintf(&sb, "  %s\n", example)
+			}
+		}
+		return sb.String(), true
+	}
+
+	fmt.Fprintln(&sb, "Allowed commands :")
+	tw := tabwriter.NewWriter(&sb, 0, 4, 2, ' ', 0)
+	for _, c := range config.AllowedCmd {
+		// no trailing tab for the missing columns, the row would be padded
+		row := strings.TrimRight(strings.Join([]string{c.Command, c.Description, c.Usage}, "\t"), "\t")
+		fmt.Fprintf(tw, "  %s\n", row)
+	}
+	tw.Flush()
+	fmt.Fprintf(&sb, "Run `%s <command>` for the examples of a command\n", helpCommand)
+	return sb.String(), true
+}
+
+// findCmd returns the allowed cmd of config named command, by path or by file name
+func findCmd(config *policy.Config, command string) *policy.Cmd {
+	for _, c := range config.AllowedCmd {
+		if c.Command == command || filepath.Base(c.Command) == command {
+			return c
+		}
+	}
+	return nil
+}
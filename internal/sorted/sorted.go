@@ -0,0 +1,14 @@
+// Package sorted returns the keys of the config maps in a stable order
+package sorted
+
+import "sort"
+
+// Keys returns the sorted keys of a map[string]string
+func Keys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
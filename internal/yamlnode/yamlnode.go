@@ -0,0 +1,25 @@
+// Package yamlnode holds the helpers walking the yaml nodes of a config file
+package yamlnode
+
+import "gopkg.in/yaml.v3"
+
+// MappingValue returns the value node of key in a mapping node, nil if not found
+func MappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// JoinPath appends key to a dotted config path
+func JoinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
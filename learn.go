@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dranih/authcmd/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// numberRegex matches the arguments generalized as numbers by suggest
+var numberRegex = regexp.MustCompile(`^[0-9]+$`)
+
+// exactArg returns an anchored regex allowing only the argument
+func exactArg(arg string) string {
+	return "^" + regexp.QuoteMeta(arg) + "$"
+}
+
+// generalizeArg returns an anchored regex allowing the argument and similar ones :
+// numbers allow any number, absolute paths allow any file of the same directory
+// and other arguments are allowed as is
+func generalizeArg(arg string) string {
+	switch {
+	case numberRegex.MatchString(arg):
+		return numberRegex.String()
+	case strings.HasPrefix(arg, "/") && !strings.HasSuffix(arg, "/") && path.Dir(arg) != "/":
+		return "^" + regexp.QuoteMeta(path.Dir(arg)) + "/[^/]+$"
+	default:
+		return exactArg(arg)
+	}
+}
+
+// suggestConfig aggregates the commands of the LEARN log lines
+// into a config with an allowedCmd entry by command, per keyTags list
+// each argument is allowed as is, or with the similar ones if generalize is set
+func suggestConfig(r io.Reader, generalize bool) (map[string]*policy.Config, map[string]int, error) {
+	argRegex := exactArg
+	if generalize {
+		argRegex = generalizeArg
+	}
+	configs := map[string]*policy.Config{}
+	seen := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		logged, ok := parseLogLine(scanner.Text())
+		if !ok || !logged.learned {
+			continue
+		}
+		parsedOriginalCmd, err := policy.ParseCommandLine(logged.originalCmd)
+		if err != nil || len(parsedOriginalCmd) == 0 {
+			continue
+		}
+		tagsKey := strings.Join(logged.tags, ",")
+		suggested, exists := configs[tagsKey]
+		if !exists {
+			suggested = &policy.Config{}
+			configs[tagsKey] = suggested
+		}
+		seen[tagsKey]++
+		var allowedCmd *policy.Cmd
+		for _, c := range suggested.AllowedCmd {
+			if c.Command == parsedOriginalCmd[0] {
+				allowedCmd = c
+			}
+		}
+		if allowedCmd == nil {
+			allowedCmd = &policy.Cmd{Command: parsedOriginalCmd[0]}
+			suggested.AllowedCmd = append(suggested.AllowedCmd, allowedCmd)
+		}
+		for _, arg := range parsedOriginalCmd[1:] {
+			if allowedCmd.Args == nil {
+				allowedCmd.Args = &policy.Args{}
+			}
+			pattern := argRegex(arg)
+			if added, _ := diffLists(allowedCmd.Args.Allowed, []string{pattern}); len(added) > 0 {
+				allowedCmd.Args.Allowed = append(allowedCmd.Args.Allowed, pattern)
+			}
+		}
+	}
+	for _, suggested := range configs {
+		for _, c := range suggested.AllowedCmd {
+			if c.Args != nil {
+				sort.Strings(c.Args.Allowed)
+			}
+		}
+	}
+	return configs, seen, scanner.Err()
+}
+
+// runSuggest implements the suggest subcommand
+// It reads the commands run in learn mode from the log and prints the allowedCmd entries
+// that would have allowed them, per keyTags, for a human to review
+// The arguments are allowed as is, unless --generalize is set
+func runSuggest(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("suggest", stderr)
+	logFile := fs.String("log", "", "log file written by authcmd in learn mode")
+	generalize := fs.Bool("generalize", false, "allow any number for a number and any file of the directory for an absolute path")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 || *logFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	f, err := os.Open(*logFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Cannot read log file : %s\n", err.Error())
+		return exitUsage
+	}
+	defer f.Close()
+	configs, seen, err := suggestConfig(f, *generalize)
+	if err != nil {
+		fmt.Fprintf(stdout, "Cannot read log file : %s\n", err.Error())
+		return exitUsage
+	}
+
+	tagsKeys := make([]string, 0, len(configs))
+	for tagsKey := range configs {
+		tagsKeys = append(tagsKeys, tagsKey)
+	}
+	sort.Strings(tagsKeys)
+	for i, tagsKey := range tagsKeys {
+		if i > 0 {
+			fmt.Fprintln(stdout, "---")
+		}
+		// the suggestion goes in the last keyTag, merged last by authcmd
+		suggested := configs[tagsKey]
+		if tagsKey == "" {
+			fmt.Fprintf(stdout, "# without keyTags, %d commands learned\n", seen[tagsKey])
+		} else {
+			fmt.Fprintf(stdout, "# keyTags `%s`, %d commands learned\n", tagsKey, seen[tagsKey])
+			tags := strings.Split(tagsKey, ",")
+			suggested = &policy.Config{KeyTags: map[string]*policy.Config{tags[len(tags)-1]: suggested}}
+		}
+		enc := yaml.NewEncoder(stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(suggested); err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return exitFailed
+		}
+		enc.Close()
+	}
+	return exitOK
+}
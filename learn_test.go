@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	header := `# without keyTags, 1 commands learned
+allowedCmd:
+  - command: uptime
+---
+# keyTags ` + "`ops,deploy`" + `, 3 commands learned
+keyTags:
+  deploy:
+    allowedCmd:
+      - command: systemctl
+        args:
+          allowed:
+            - ^app$
+            - ^restart$
+      - command: tail
+        args:
+          allowed:
+            - ^-n$
+`
+	tt := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "exact",
+			args: []string{"--log", "tests/authcmd_learn_test.log"},
+			want: header + `            - ^/var/log/app/app\.log$
+            - ^/var/log/app/error\.log$
+            - ^100$
+            - ^20$
+`,
+		},
+		{
+			name: "generalize",
+			args: []string{"--log", "tests/authcmd_learn_test.log", "--generalize"},
+			want: header + `            - ^/var/log/app/[^/]+$
+            - ^[0-9]+$
+`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runSuggest(tc.args, &stdout, &stderr)
+			if exitCode != exitOK {
+				t.Errorf("Want exit code '%d', got '%d'", exitOK, exitCode)
+			}
+			if stdout.String() != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, stdout.String())
+			}
+		})
+	}
+}
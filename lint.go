@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// Severities of a lint finding, by increasing order
+const (
+	severityInfo = iota
+	severityWarning
+	severityError
+)
+
+// severityNames holds the names of the severities as used in output and --fail-on
+var severityNames = []string{"info", "warning", "error"}
+
+// shellMetaChars are the probes checked against the forbidden regex of a cmd run with a shell
+var shellMetaChars = []string{";", "|", "&", "`", "$(", ">", "<", "\n"}
+
+// leadingSpace matches a regex accepting a space after its ^ anchor
+var leadingSpace = regexp.MustCompile(`^\^(\s|\\s| |\[[^\]]*( |\\s)[^\]]*\]|\.)`)
+
+// A lintFinding is a dangerous or ineffective rule found in a merged config
+// the command is empty for a finding on the config settings
+type lintFinding struct {
+	severity int
+	scope    string
+	command  string
+	msg      string
+	fix      string
+}
+
+// key identifies a finding independently of its scope
+func (f lintFinding) key() string {
+	return fmt.Sprintf("%d\x00%s\x00%s", f.severity, f.command, f.msg)
+}
+
+// A lintCmd is an allowed cmd with its regex compiled for the lint rules
+type lintCmd struct {
+	*policy.Cmd
+	allowed   []*regexp.Regexp
+	forbidden []*regexp.Regexp
+	mustMatch []*regexp.Regexp
+}
+
+// newLintCmd compiles the regex of an allowed cmd of a loaded policy, already checked
+func newLintCmd(allowedCmd *policy.Cmd) *lintCmd {
+	compileAll := func(patterns []string) []*regexp.Regexp {
+		compiled := []*regexp.Regexp{}
+		for _, pattern := range patterns {
+			compiled = append(compiled, regexp.MustCompile(pattern))
+		}
+		return compiled
+	}
+	c := &lintCmd{Cmd: allowedCmd, mustMatch: compileAll(allowedCmd.MustMatch)}
+	if allowedCmd.Args != nil {
+		c.forbidden = compileAll(allowedCmd.Args.Forbidden)
+		// a non nil allowed list restricts the args even if empty
+		if allowedCmd.Args.Allowed != nil {
+			c.allowed = compileAll(allowedCmd.Args.Allowed)
+		}
+	}
+	return c
+}
+
+// lintConfig analyses the effective config and returns its findings for scope
+func lintConfig(config *policy.Config, scope string) []lintFinding {
+	var findings []lintFinding
+	add := func(severity int, command string, fix string, msg string, args ...interface{}) {
+		findings = append(findings, lintFinding{severity: severity, scope: scope, command: command, msg: fmt.Sprintf(msg, args...), fix: fix})
+	}
+	// denied commands run in learn mode are only recorded in the log
+	if config.Mode == "learn" && (config.EnableLogging == nil || !*config.EnableLogging) {
+		add(severityError, "", "set `enableLogging: true`", "mode is learn without enableLogging, denied commands are run and not recorded")
+	}
+	expandEnvVars := config.ExpandEnvVars != nil && *config.ExpandEnvVars
+	for _, allowedCmd := range config.AllowedCmd {
+		c := newLintCmd(allowedCmd)
+		if !strings.HasPrefix(c.Command, "/") {
+			fix := "use an absolute path"
+			if path, err := exec.LookPath(c.Command); err == nil {
+				fix = fmt.Sprintf("use `%s`", path)
+			}
+			add(severityWarning, c.Command, fix, "relative command is resolved through PATH and can be hijacked")
+		}
+		for _, re := range c.allowed {
+			if !isAnchored(re.String()) {
+				msg := "allowed regex `%s` is not anchored, it also matches any argument containing a match"
+				// a literal regex gives a real example
+				if regexp.QuoteMeta(re.String()) == re.String() {
+					msg = "allowed regex `%s` is not anchored, it also matches `--exec=" + re.String() + "`"
+				}
+				add(severityWarning, c.Command, fmt.Sprintf("use `%s`", anchor(re.String())), msg, re)
+			}
+			if re.MatchString("") && re.String() != "^$" {
+				add(severityInfo, c.Command, "", "allowed regex `%s` matches any argument", re)
+			}
+		}
+		// mustMatch regex are matched against the arguments line, starting with a space
+		// a regex anchored at the start only is a prefix of the arguments line
+		for _, re := range c.mustMatch {
+			fix := fmt.Sprintf("use `%s`", anchorStart(re.String()))
+			if !strings.HasPrefix(re.String(), "^") && !strings.HasPrefix(re.String(), `\A`) {
+				add(severityWarning, c.Command, fix, "mustMatch regex `%s` is not anchored, extra arguments can be added before the match", re)
+			} else if strings.HasPrefix(re.String(), "^") && !re.MatchString(" ") && !leadingSpace.MatchString(re.String()) {
+				add(severityWarning, c.Command, fix, "mustMatch regex `%s` can not match, the arguments line starts with a space", re)
+			}
+		}
+		if c.allowed == nil && len(c.forbidden) == 0 && len(c.mustMatch) == 0 {
+			add(severityInfo, c.Command, "add args.allowed regex", "any argument is allowed")
+		}
+		if config.UseShell != "" {
+			if missing := unforbidden(c, shellMetaChars); len(missing) > 0 {
+				add(severityError, c.Command, "add a forbidden regex matching the shell metacharacters, like `[;|&$<>\\x60\\n]`",
+					"useShell is set and shell metacharacters %q are not forbidden, `; rm` can be injected", missing)
+			}
+		}
+		if expandEnvVars && len(unforbidden(c, []string{"$"})) > 0 {
+			severity := severityWarning
+			msg := "expandEnvVars is set and `$` is not forbidden, callers can read env vars"
+			if len(config.SetEnvVars) > 0 || len(c.SetEnvVars) > 0 {
+				severity = severityError
+				msg += " including the setEnvVars values"
+			}
+			add(severity, c.Command, "add a forbidden regex `\\$`", msg)
+		}
+	}
+	return findings
+}
+
+// isAnchored returns true if the regex is anchored at both ends
+func isAnchored(pattern string) bool {
+	return (strings.HasPrefix(pattern, "^") || strings.HasPrefix(pattern, `\A`)) &&
+		(strings.HasSuffix(pattern, "$") && !strings.HasSuffix(pattern, `\$`) || strings.HasSuffix(pattern, `\z`))
+}
+
+// anchor returns the regex anchored at both ends
+func anchor(pattern string) string {
+	pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	if strings.Contains(pattern, "|") {
+		pattern = "(?:" + pattern + ")"
+	}
+	return "^" + pattern + "$"
+}
+
+// anchorStart returns the regex anchored at the start of the arguments line, after its leading space
+// its end is kept, a prefix regex stays a prefix
+func anchorStart(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "^")
+	if strings.Contains(pattern, "|") {
+		pattern = "(?:" + pattern + ")"
+	}
+	return `^\s*` + pattern
+}
+
+// unforbidden returns the probes not matched by any forbidden regex of the cmd
+func unforbidden(c *lintCmd, probes []string) []string {
+	var missing []string
+	for _, probe := range probes {
+		forbidden := false
+		for _, re := range c.forbidden {
+			if re.MatchString("a" + probe + "b") {
+				forbidden = true
+				break
+			}
+		}
+		if !forbidden {
+			missing = append(missing, probe)
+		}
+	}
+	return missing
+}
+
+// runLint implements the lint subcommand
+// It analyses the config without keyTags and merged with each keyTag
+// findings of a keyTag already found without keyTags are not repeated
+// Exit code is exitFailed if a finding has at least the --fail-on severity
+func runLint(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("lint", stderr)
+	configFile := fs.String("config", "", "config file (default : same lookup as authcmd)")
+	failOn := fs.String("fail-on", "error", "lowest severity failing the lint : info, warning, error or none")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	failLevel := len(severityNames)
+	for i, name := range severityNames {
+		if name == *failOn {
+			failLevel = i
+		}
+	}
+	if fs.NArg() > 0 || (failLevel == len(severityNames) && *failOn != "none") {
+		fs.Usage()
+		return exitUsage
+	}
+
+	p, err := loadPolicy(*configFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	base, err := p.Effective(nil)
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	findings := lintConfig(base, "base")
+	seen := map[string]bool{}
+	for _, f := range findings {
+		seen[f.key()] = true
+	}
+	for _, tag := range p.Base().Tags() {
+		merged, err := p.Effective([]string{tag})
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		for _, f := range lintConfig(merged, "keyTag `"+tag+"`") {
+			if !seen[f.key()] {
+				findings = append(findings, f)
+			}
+		}
+	}
+
+	ret := exitOK
+	for _, f := range findings {
+		where := f.scope
+		if f.command != "" {
+			where += " command `" + f.command + "`"
+		}
+		fmt.Fprintf(stdout, "[%s] %s : %s\n", severityNames[f.severity], where, f.msg)
+		if f.fix != "" {
+			fmt.Fprintf(stdout, "    fix : %s\n", f.fix)
+		}
+		if f.severity >= failLevel {
+			ret = exitFailed
+		}
+	}
+	return ret
+}
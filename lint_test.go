@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	findings := []string{
+		"[warning] base command `/bin/ls` : allowed regex `-a` is not anchored, it also matches `--exec=-a`",
+		"    fix : use `^-a$`",
+		"[error] keyTag `expand` command `/bin/ls` : expandEnvVars is set and `$` is not forbidden, callers can read env vars including the setEnvVars values",
+		"    fix : add a forbidden regex `\\$`",
+		"[warning] keyTag `expand` command `/bin/cat` : mustMatch regex `^/var/log/` can not match, the arguments line starts with a space",
+		"    fix : use `^\\s*/var/log/`",
+		"[error] keyTag `expand` command `/bin/cat` : expandEnvVars is set and `$` is not forbidden, callers can read env vars including the setEnvVars values",
+		"    fix : add a forbidden regex `\\$`",
+		"[warning] keyTag `expand` command `/bin/tail` : mustMatch regex `/var/log/` is not anchored, extra arguments can be added before the match",
+		"    fix : use `^\\s*/var/log/`",
+		"[error] keyTag `learn` : mode is learn without enableLogging, denied commands are run and not recorded",
+		"    fix : set `enableLogging: true`",
+		"[warning] keyTag `learn` command `authcmd-lint-relative` : relative command is resolved through PATH and can be hijacked",
+		"    fix : use an absolute path",
+		"[error] keyTag `shell` command `/bin/ls` : useShell is set and shell metacharacters [\";\" \"|\" \"&\" \"`\" \"$(\" \">\" \"<\" \"\\n\"] are not forbidden, `; rm` can be injected",
+		"    fix : add a forbidden regex matching the shell metacharacters, like `[;|&$<>\\x60\\n]`",
+		"[error] keyTag `shell` command `/bin/echo` : useShell is set and shell metacharacters [\"&\" \"`\" \"$(\" \">\" \"<\" \"\\n\"] are not forbidden, `; rm` can be injected",
+		"    fix : add a forbidden regex matching the shell metacharacters, like `[;|&$<>\\x60\\n]`",
+	}
+	tt := []struct {
+		name     string
+		args     []string
+		exitCode int
+	}{
+		{name: "default fail on error", args: []string{"--config", "tests/authcmd_lint_test.yml"}, exitCode: exitFailed},
+		{name: "fail on none", args: []string{"--config", "tests/authcmd_lint_test.yml", "--fail-on", "none"}, exitCode: exitOK},
+		{name: "unknown severity", args: []string{"--config", "tests/authcmd_lint_test.yml", "--fail-on", "fatal"}, exitCode: exitUsage},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runLint(tc.args, &stdout, &stderr)
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d'", tc.exitCode, exitCode)
+			}
+			if tc.exitCode != exitUsage && strings.TrimSpace(stdout.String()) != strings.Join(findings, "\n") {
+				t.Errorf("Want '%s', got '%s'", strings.Join(findings, "\n"), stdout.String())
+			}
+		})
+	}
+}
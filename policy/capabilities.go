@@ -0,0 +1,53 @@
+package policy
+
+// Levels of the capabilities config
+const (
+	// CapabilitiesCommands reveals the allowed commands with their description, usage and examples
+	CapabilitiesCommands = "commands"
+	// CapabilitiesArgs also reveals the regex constraining the arguments of the allowed commands
+	CapabilitiesArgs = "args"
+)
+
+// A Capability is an allowed command as revealed to the clients
+type Capability struct {
+	Command     string   `json:"command"`
+	Description string   `json:"description,omitempty"`
+	Usage       string   `json:"usage,omitempty"`
+	Examples    []string `json:"examples,omitempty"`
+	// Stdin is true if the stdin of the client is given to the command
+	Stdin bool `json:"stdin"`
+	// Args and MustMatch are only set at the args capabilities level
+	Args      *Args    `json:"args,omitempty"`
+	MustMatch []string `json:"mustMatch,omitempty"`
+}
+
+// ListCapabilities returns the allowed commands of the effective config as revealed by its capabilities level
+// nil is returned if capabilities is not set
+func (config *Config) ListCapabilities() []*Capability {
+	if config.Capabilities != CapabilitiesCommands && config.Capabilities != CapabilitiesArgs {
+		return nil
+	}
+	capabilities := []*Capability{}
+	for _, allowedCmd := range config.AllowedCmd {
+		c := &Capability{
+			Command:     allowedCmd.Command,
+			Description: allowedCmd.Description,
+			Usage:       allowedCmd.Usage,
+			Examples:    cloneSlice(allowedCmd.Examples),
+			Stdin:       allowedCmd.AcceptsStdin(),
+		}
+		if config.Capabilities == CapabilitiesArgs {
+			if allowedCmd.Args != nil {
+				c.Args = &Args{Allowed: cloneSlice(allowedCmd.Args.Allowed), Forbidden: cloneSlice(allowedCmd.Args.Forbidden)}
+			}
+			c.MustMatch = cloneSlice(allowedCmd.MustMatch)
+		}
+		capabilities = append(capabilities, c)
+	}
+	return capabilities
+}
+
+// AcceptsStdin returns true if the stdin of the client is given to the allowed cmd
+func (allowedCmd *Cmd) AcceptsStdin() bool {
+	return allowedCmd.Stdin != nil && *allowedCmd.Stdin
+}
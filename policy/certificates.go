@@ -0,0 +1,175 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// certTagValue matches a keyTag taken from a certificate, so a value like `key=value` can not set a param
+var certTagValue = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.@-]*$`)
+
+// A Certificate is an OpenSSH user certificate which authenticated the ssh client
+type Certificate struct {
+	Serial     uint64
+	KeyID      string
+	Principals []string
+	// ValidAfter and ValidBefore are unix times, ValidBefore is the max uint64 for a certificate valid forever
+	ValidAfter  uint64
+	ValidBefore uint64
+	// CriticalOptions and Extensions are the values by name, empty for the flags like permit-pty
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+	// CA is the SHA256 fingerprint of the key which signed the certificate
+	CA string
+}
+
+// A CertRule maps the certificates authenticating ssh clients to keyTags
+// a certificate matches if it is signed by CA, has a principal matching Principal,
+// a key ID matching KeyID and the critical option or extension Option, for those set
+type CertRule struct {
+	Description string `yaml:"description,omitempty" json:"description,omitempty"`
+	// CA is the SHA256 fingerprint of the CA key, as printed by ssh-keygen -l, required
+	CA string `yaml:"ca,omitempty" json:"ca,omitempty"`
+	// Principal and KeyID are regex matching the whole value, the submatches of each matching principal,
+	// or of the key ID, expand $1 in Tags
+	Principal string `yaml:"principal,omitempty" json:"principal,omitempty"`
+	KeyID     string `yaml:"keyId,omitempty" json:"keyId,omitempty"`
+	// Option is a critical option or extension, its comma separated value are keyTags added to Tags
+	Option string   `yaml:"option,omitempty" json:"option,omitempty"`
+	Tags   []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// Clone returns a deep copy of the certificate rule
+func (rule *CertRule) Clone() *CertRule {
+	c := *rule
+	c.Tags = cloneSlice(rule.Tags)
+	return &c
+}
+
+// check returns an error if the CA fingerprint is missing or invalid or if a regex of the rule is invalid
+func (rule *CertRule) check() error {
+	if rule.CA == "" {
+		return errors.New("ca is required")
+	}
+	if _, err := (&Key{Key: rule.CA}).Fingerprint(); err != nil || !strings.HasPrefix(rule.CA, "SHA256:") {
+		return fmt.Errorf("ca `%s` is not a SHA256 fingerprint", rule.CA)
+	}
+	for _, re := range []string{rule.Principal, rule.KeyID} {
+		if _, err := anchored(re); err != nil {
+			return fmt.Errorf("regex `%s` : %s", re, err.Error())
+		}
+	}
+	return nil
+}
+
+// anchored compiles the regex re to match a whole value
+func anchored(re string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + re + ")$")
+}
+
+// tags returns the keyTags of the certificate given by the rule, nil if it does not match
+// the values taken from the certificate which are not plain keyTag names are ignored
+func (rule *CertRule) tags(cert *Certificate) []string {
+	if rule.CA == "" || rule.CA != cert.CA {
+		return nil
+	}
+	var tags []string
+	add := func(tag string) {
+		if tag = strings.TrimSpace(tag); tag != "" && !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	// expand adds the tags with the submatches of re in value, it returns false if re does not match
+	// or if a submatch is not a plain keyTag name
+	expand := func(re *regexp.Regexp, value string) bool {
+		match := re.FindStringSubmatchIndex(value)
+		if match == nil {
+			return false
+		}
+		for i := 2; i+1 < len(match); i += 2 {
+			if match[i] >= 0 && match[i] < match[i+1] && !certTagValue.MatchString(value[match[i]:match[i+1]]) {
+				return false
+			}
+		}
+		for _, tag := range rule.Tags {
+			add(string(re.ExpandString(nil, tag, value, match)))
+		}
+		return true
+	}
+	if rule.KeyID != "" {
+		re, err := anchored(rule.KeyID)
+		if err != nil || !re.MatchString(cert.KeyID) {
+			return nil
+		}
+		if rule.Principal == "" && !expand(re, cert.KeyID) {
+			return nil
+		}
+	}
+	if rule.Principal != "" {
+		re, err := anchored(rule.Principal)
+		if err != nil {
+			return nil
+		}
+		matched := false
+		for _, principal := range cert.Principals {
+			matched = expand(re, principal) || matched
+		}
+		if !matched {
+			return nil
+		}
+	}
+	if rule.Option != "" {
+		value, ok := cert.CriticalOptions[rule.Option]
+		if extension, isExtension := cert.Extensions[rule.Option]; isExtension {
+			value, ok = extension, true
+		}
+		if !ok {
+			return nil
+		}
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); certTagValue.MatchString(tag) {
+				add(tag)
+			}
+		}
+	}
+	if rule.KeyID == "" && rule.Principal == "" {
+		for _, tag := range rule.Tags {
+			add(tag)
+		}
+	}
+	return tags
+}
+
+// Valid returns an error if the certificate is not valid at the time t
+func (cert *Certificate) Valid(t time.Time) error {
+	now := uint64(t.Unix())
+	if now < cert.ValidAfter {
+		return fmt.Errorf("certificate `%s` not valid before %s", cert.KeyID, time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339))
+	}
+	if now >= cert.ValidBefore {
+		return fmt.Errorf("certificate `%s` expired at %s", cert.KeyID, time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// newCertificate returns the Certificate of a parsed OpenSSH user certificate
+func newCertificate(cert *ssh.Certificate) (*Certificate, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("certificate `%s` is not a user certificate", cert.KeyId)
+	}
+	return &Certificate{
+		Serial:          cert.Serial,
+		KeyID:           cert.KeyId,
+		Principals:      cloneSlice(cert.ValidPrincipals),
+		ValidAfter:      cert.ValidAfter,
+		ValidBefore:     cert.ValidBefore,
+		CriticalOptions: cloneMap(cert.CriticalOptions),
+		Extensions:      cloneMap(cert.Extensions),
+		CA:              ssh.FingerprintSHA256(cert.SignatureKey),
+	}, nil
+}
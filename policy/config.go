@@ -0,0 +1,583 @@
+package policy
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/sorted"
+)
+
+// Config holds the configuration parsed from the authcmd.yml
+// A Config merged with keyTags is the effective config of a request
+type Config struct {
+	ShowTerseDenied *bool              `yaml:"showTerseDenied,omitempty" json:"showTerseDenied,omitempty"`
+	ShowAllowed     *bool              `yaml:"showAllowed,omitempty" json:"showAllowed,omitempty"`
+	ShowDenied      *bool              `yaml:"showDenied,omitempty" json:"showDenied,omitempty"`
+	ExpandEnvVars   *bool              `yaml:"expandEnvVars,omitempty" json:"expandEnvVars,omitempty"`
+	EnableLogging   *bool              `yaml:"enableLogging,omitempty" json:"enableLogging,omitempty"`
+	EnableHelp      *bool              `yaml:"enableHelp,omitempty" json:"enableHelp,omitempty"`
+	LogFile         string             `yaml:"logFile,omitempty" json:"logFile,omitempty"`
+	UseShell        string             `yaml:"useShell,omitempty" json:"useShell,omitempty"`
+	HelpText        string             `yaml:"helpText,omitempty" json:"helpText,omitempty"`
+	DeniedTemplate  string             `yaml:"deniedTemplate,omitempty" json:"deniedTemplate,omitempty"`
+	DeniedOutput    string             `yaml:"deniedOutput,omitempty" json:"deniedOutput,omitempty"`
+	SupportContact  string             `yaml:"supportContact,omitempty" json:"supportContact,omitempty"`
+	Capabilities    string             `yaml:"capabilities,omitempty" json:"capabilities,omitempty"`
+	LogDecisions    string             `yaml:"logDecisions,omitempty" json:"logDecisions,omitempty"`
+	Mode            string             `yaml:"mode,omitempty" json:"mode,omitempty"`
+	Strict          *bool              `yaml:"strict,omitempty" json:"strict,omitempty"`
+	Include         []string           `yaml:"include,omitempty" json:"include,omitempty"`
+	Merge           string             `yaml:"merge,omitempty" json:"merge,omitempty"`
+	RemoveCmd       []string           `yaml:"removeCmd,omitempty" json:"removeCmd,omitempty"`
+	Extends         []string           `yaml:"extends,omitempty" json:"extends,omitempty"`
+	Params          map[string]*Param  `yaml:"params,omitempty" json:"params,omitempty"`
+	Variables       map[string]string  `yaml:"variables,omitempty" json:"variables,omitempty"`
+	ExitCodes       map[string]int     `yaml:"exitCodes,omitempty" json:"exitCodes,omitempty"`
+	SetEnvVars      map[string]string  `yaml:"setEnvVars,omitempty" json:"setEnvVars,omitempty"`
+	AllowedCmd      []*Cmd             `yaml:"allowedCmd,omitempty" json:"allowedCmd,omitempty"`
+	Profiles        map[string]*Config `yaml:"profiles,omitempty" json:"profiles,omitempty"`
+	Keys            []*Key             `yaml:"keys,omitempty" json:"keys,omitempty"`
+	Certificates    []*CertRule        `yaml:"certificates,omitempty" json:"certificates,omitempty"`
+	KeyTags         map[string]*Config `yaml:"keyTags,omitempty" json:"keyTags,omitempty"`
+}
+
+// A Cmd is the config detail of an allowed cmd from the authcmd.yml config file
+type Cmd struct {
+	Command     string            `yaml:"command,omitempty" json:"command,omitempty"`
+	Description string            `yaml:"description,omitempty" json:"description,omitempty"`
+	Usage       string            `yaml:"usage,omitempty" json:"usage,omitempty"`
+	Examples    []string          `yaml:"examples,omitempty" json:"examples,omitempty"`
+	Args        *Args             `yaml:"args,omitempty" json:"args,omitempty"`
+	Replace     map[string]string `yaml:"replace,omitempty" json:"replace,omitempty"`
+	SetEnvVars  map[string]string `yaml:"setEnvVars,omitempty" json:"setEnvVars,omitempty"`
+	MustMatch   []string          `yaml:"mustMatch,omitempty" json:"mustMatch,omitempty"`
+	Stdin       *bool             `yaml:"stdin,omitempty" json:"stdin,omitempty"`
+	Completions []string          `yaml:"completions,omitempty" json:"completions,omitempty"`
+	Merge       string            `yaml:"merge,omitempty" json:"merge,omitempty"`
+}
+
+// Merge strategies of the allowed cmds of a keyTag with the existing cmds of the same command
+const (
+	// MergeAppend adds the args regex, mustMatch, replace rules and env vars to the existing cmd, the default
+	MergeAppend = "append"
+	// MergeReplace replaces the existing cmd
+	MergeReplace = "replace"
+	// MergeRemove removes the args regex, mustMatch, replace rules and env vars listed from the existing cmd
+	MergeRemove = "remove"
+)
+
+// Args is the detail of the allowed and forbidden args of an allowed cmd
+type Args struct {
+	Allowed   []string `yaml:"allowed,omitempty" json:"allowed,omitempty"`
+	Forbidden []string `yaml:"forbidden,omitempty" json:"forbidden,omitempty"`
+}
+
+// A compiledCmd is an allowed cmd with all its regex compiled
+type compiledCmd struct {
+	*Cmd
+	allowed   []pattern
+	forbidden []pattern
+	mustMatch []pattern
+	replace   []replaceRule
+	// missing is a param or variable used by the cmd without value, the cmd is then denied
+	missing string
+}
+
+// A pattern is a compiled args regex with the keyTag which added it, empty if from the base config
+type pattern struct {
+	*regexp.Regexp
+	tag string
+}
+
+// A replaceRule is a compiled replace regex of a cmd with its replacement string
+type replaceRule struct {
+	search  *regexp.Regexp
+	replace string
+}
+
+// Clone returns a deep copy of the config, profiles and keyTags included
+func (config *Config) Clone() *Config {
+	c := *config
+	c.SetEnvVars = cloneMap(config.SetEnvVars)
+	c.Variables = cloneMap(config.Variables)
+	c.Include = cloneSlice(config.Include)
+	c.RemoveCmd = cloneSlice(config.RemoveCmd)
+	if config.ExitCodes != nil {
+		c.ExitCodes = make(map[string]int, len(config.ExitCodes))
+		for key, code := range config.ExitCodes {
+			c.ExitCodes[key] = code
+		}
+	}
+	c.AllowedCmd = nil
+	for _, allowedCmd := range config.AllowedCmd {
+		c.AllowedCmd = append(c.AllowedCmd, allowedCmd.Clone())
+	}
+	c.Extends = cloneSlice(config.Extends)
+	if config.Params != nil {
+		c.Params = make(map[string]*Param, len(config.Params))
+		for name, param := range config.Params {
+			if param != nil {
+				param = param.Clone()
+			}
+			c.Params[name] = param
+		}
+	}
+	c.Profiles = cloneConfigs(config.Profiles)
+	c.Keys = nil
+	for _, key := range config.Keys {
+		c.Keys = append(c.Keys, key.Clone())
+	}
+	c.Certificates = nil
+	for _, rule := range config.Certificates {
+		c.Certificates = append(c.Certificates, rule.Clone())
+	}
+	c.KeyTags = cloneConfigs(config.KeyTags)
+	return &c
+}
+
+// cloneConfigs returns a deep copy of the keyTags or profiles m, nil if m is nil
+func cloneConfigs(m map[string]*Config) map[string]*Config {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]*Config, len(m))
+	for name, config := range m {
+		if config != nil {
+			config = config.Clone()
+		}
+		c[name] = config
+	}
+	return c
+}
+
+// Clone returns a deep copy of the allowed cmd
+func (allowedCmd *Cmd) Clone() *Cmd {
+	c := *allowedCmd
+	if allowedCmd.Args != nil {
+		c.Args = &Args{Allowed: cloneSlice(allowedCmd.Args.Allowed), Forbidden: cloneSlice(allowedCmd.Args.Forbidden)}
+	}
+	c.Replace = cloneMap(allowedCmd.Replace)
+	c.SetEnvVars = cloneMap(allowedCmd.SetEnvVars)
+	c.MustMatch = cloneSlice(allowedCmd.MustMatch)
+	c.Examples = cloneSlice(allowedCmd.Examples)
+	c.Completions = cloneSlice(allowedCmd.Completions)
+	return &c
+}
+
+// cloneMap returns a copy of m, nil if m is nil
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	return c
+}
+
+// cloneSlice returns a copy of s, nil if s is nil
+func cloneSlice(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	return append([]string{}, s...)
+}
+
+// mergeConfig merges the tagConfig *Config in parameter
+// *bool and string parameters are overrides if in the tagConfig
+// The commands of removeCmd are removed, then each allowedCmd is appended if it does not exist,
+// or merged with the existing cmd with its merge strategy, or the one of the tagConfig (append by default)
+// tagConfig is not modified
+func (config *Config) mergeConfig(tagConfig *Config) {
+	fields := reflect.VisibleFields(reflect.TypeOf(struct{ Config }{}))
+	tc := reflect.Indirect(reflect.ValueOf(tagConfig))
+	c := reflect.Indirect(reflect.ValueOf(config))
+
+	for _, field := range fields {
+		// merge is the strategy of the tagConfig, not a setting
+		if !field.IsExported() || field.Name == "Merge" {
+			continue
+		}
+		switch field.Type {
+		//Merging *bool and string parameters
+		case reflect.TypeOf((*bool)(nil)), reflect.TypeOf((string)("")):
+			tcbyname := tc.FieldByName(field.Name)
+			cbyname := c.FieldByName(field.Name)
+			if tcbyname.IsValid() && cbyname.IsValid() &&
+				(tcbyname.Kind() == reflect.Ptr && !tcbyname.IsNil()) || (tcbyname.Kind() == reflect.String && !tcbyname.IsZero()) {
+				if cbyname.CanSet() {
+					cbyname.Set(tcbyname)
+				}
+			}
+		//Merging map[string]string and map[string]int parameters
+		case reflect.TypeOf((map[string]string)(nil)), reflect.TypeOf((map[string]int)(nil)):
+			tcbyname := tc.FieldByName(field.Name)
+			cbyname := c.FieldByName(field.Name)
+			if tcbyname.IsValid() && cbyname.IsValid() && !tcbyname.IsNil() {
+				if cbyname.IsNil() {
+					cbyname.Set(reflect.MakeMap(field.Type))
+				}
+				iter := tcbyname.MapRange()
+				for iter.Next() {
+					cbyname.SetMapIndex(iter.Key(), iter.Value())
+				}
+			}
+		}
+	}
+	//Merging params, a param of the tagConfig replaces the one of the same name
+	for name, param := range tagConfig.Params {
+		if config.Params == nil {
+			config.Params = map[string]*Param{}
+		}
+		if param != nil {
+			param = param.Clone()
+		}
+		config.Params[name] = param
+	}
+	//Removing the cmds of removeCmd
+	if len(tagConfig.RemoveCmd) > 0 {
+		kept := make([]*Cmd, 0, len(config.AllowedCmd))
+		for _, existingCmd := range config.AllowedCmd {
+			if !contains(tagConfig.RemoveCmd, existingCmd.Command) {
+				kept = append(kept, existingCmd)
+			}
+		}
+		config.AllowedCmd = kept
+	}
+	//Merging allowedCmd
+	for _, tagCmd := range tagConfig.AllowedCmd {
+		strategy := tagCmd.Merge
+		if strategy == "" {
+			strategy = tagConfig.Merge
+		}
+		existsID := -1
+		for i, existingCmd := range config.AllowedCmd {
+			if tagCmd.Command == existingCmd.Command {
+				existsID = i
+			}
+		}
+		switch {
+		case existsID == -1 && strategy == MergeRemove:
+			// nothing to remove from
+		case existsID == -1:
+			config.AllowedCmd = append(config.AllowedCmd, tagCmd.Clone())
+		case strategy == MergeReplace:
+			config.AllowedCmd[existsID] = tagCmd.Clone()
+		case strategy == MergeRemove:
+			config.AllowedCmd[existsID].removeCmd(tagCmd)
+		default:
+			config.AllowedCmd[existsID].appendCmd(tagCmd)
+		}
+	}
+}
+
+// cmdStrategies sets the merge strategy of the config on its allowed cmds without one
+// so the config can be merged with another config of the same keyTag, which may have another strategy
+func (config *Config) cmdStrategies() {
+	for _, allowedCmd := range config.AllowedCmd {
+		if allowedCmd.Merge == "" {
+			allowedCmd.Merge = config.Merge
+		}
+	}
+	config.Merge = ""
+}
+
+// resetMerge clears the merge strategies and removeCmd of a merged config, already applied
+func (config *Config) resetMerge() {
+	config.Merge = ""
+	config.RemoveCmd = nil
+	for _, allowedCmd := range config.AllowedCmd {
+		allowedCmd.Merge = ""
+	}
+}
+
+// appendCmd merges the tagCmd with the append strategy
+// descriptions and stdin are overrides, args regex, mustMatch, replace rules and env vars are added
+func (existingCmd *Cmd) appendCmd(tagCmd *Cmd) {
+	if tagCmd.Description != "" {
+		existingCmd.Description = tagCmd.Description
+	}
+	if tagCmd.Usage != "" {
+		existingCmd.Usage = tagCmd.Usage
+	}
+	if tagCmd.Examples != nil {
+		existingCmd.Examples = cloneSlice(tagCmd.Examples)
+	}
+	if tagCmd.Completions != nil {
+		existingCmd.Completions = cloneSlice(tagCmd.Completions)
+	}
+	if tagCmd.Stdin != nil {
+		existingCmd.Stdin = tagCmd.Stdin
+	}
+	if tagCmd.Args != nil {
+		if existingCmd.Args == nil {
+			existingCmd.Args = &Args{}
+		}
+		if len(tagCmd.Args.Forbidden) > 0 {
+			existingCmd.Args.Forbidden = append(cloneSlice(existingCmd.Args.Forbidden), tagCmd.Args.Forbidden...)
+		}
+		if len(tagCmd.Args.Allowed) > 0 {
+			existingCmd.Args.Allowed = append(cloneSlice(existingCmd.Args.Allowed), tagCmd.Args.Allowed...)
+		}
+	}
+	if existingCmd.Replace == nil && tagCmd.Replace != nil {
+		existingCmd.Replace = map[string]string{}
+	}
+	for a, b := range tagCmd.Replace {
+		existingCmd.Replace[a] = b
+	}
+	if existingCmd.SetEnvVars == nil && tagCmd.SetEnvVars != nil {
+		existingCmd.SetEnvVars = map[string]string{}
+	}
+	for a, b := range tagCmd.SetEnvVars {
+		existingCmd.SetEnvVars[a] = b
+	}
+	if len(tagCmd.MustMatch) > 0 {
+		existingCmd.MustMatch = append(cloneSlice(existingCmd.MustMatch), tagCmd.MustMatch...)
+	}
+}
+
+// removeCmd merges the tagCmd with the remove strategy
+// the args regex and mustMatch regex of the tagCmd are removed, as are the replace rules and env vars of its keys
+func (existingCmd *Cmd) removeCmd(tagCmd *Cmd) {
+	if existingCmd.Args != nil && tagCmd.Args != nil {
+		existingCmd.Args = &Args{
+			Allowed:   removeAll(existingCmd.Args.Allowed, tagCmd.Args.Allowed),
+			Forbidden: removeAll(existingCmd.Args.Forbidden, tagCmd.Args.Forbidden),
+		}
+	}
+	existingCmd.MustMatch = removeAll(existingCmd.MustMatch, tagCmd.MustMatch)
+	if len(tagCmd.Replace) > 0 {
+		existingCmd.Replace = cloneMap(existingCmd.Replace)
+		for a := range tagCmd.Replace {
+			delete(existingCmd.Replace, a)
+		}
+	}
+	if len(tagCmd.SetEnvVars) > 0 {
+		existingCmd.SetEnvVars = cloneMap(existingCmd.SetEnvVars)
+		for a := range tagCmd.SetEnvVars {
+			delete(existingCmd.SetEnvVars, a)
+		}
+	}
+}
+
+// removeAll returns a copy of s without the values of removed
+// the copy of a non nil s is not nil, even empty : an empty allowed list still allows no argument
+func removeAll(s []string, removed []string) []string {
+	if s == nil {
+		return nil
+	}
+	kept := []string{}
+	for _, value := range s {
+		if !contains(removed, value) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// checkEntries returns an error listing the null allowed cmds, keys and certificate rules of the config
+// and of its profiles and keyTags, e.g. an empty list item, so they are rejected before the config is used
+func (config *Config) checkEntries() error {
+	var errs []string
+	checkCmds := func(prefix string, c *Config) {
+		for i, allowedCmd := range c.AllowedCmd {
+			if allowedCmd == nil {
+				errs = append(errs, fmt.Sprintf("%s`allowedCmd[%d]` is empty", prefix, i))
+			}
+		}
+	}
+	checkCmds("", config)
+	for i, key := range config.Keys {
+		if key == nil {
+			errs = append(errs, fmt.Sprintf("`keys[%d]` is empty", i))
+		}
+	}
+	for i, rule := range config.Certificates {
+		if rule == nil {
+			errs = append(errs, fmt.Sprintf("`certificates[%d]` is empty", i))
+		}
+	}
+	for _, name := range sortedNames(config.Profiles) {
+		if config.Profiles[name] != nil {
+			checkCmds(fmt.Sprintf("profile `%s` ", name), config.Profiles[name])
+		}
+	}
+	for _, name := range sortedNames(config.KeyTags) {
+		if config.KeyTags[name] != nil {
+			checkCmds(fmt.Sprintf("keyTag `%s` ", name), config.KeyTags[name])
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// checkRegex compiles the regex of the allowed cmds and the deniedTemplate of the config
+// and of all its profiles and keyTags and returns an error listing every invalid regex or template
+func (config *Config) checkRegex() error {
+	var errs []string
+	if _, err := parseDeniedTemplate(config.DeniedTemplate); err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, allowedCmd := range config.AllowedCmd {
+		_, cmdErrs := compileCmd(allowedCmd)
+		errs = append(errs, cmdErrs...)
+	}
+	checkParams := func(prefix string, params map[string]*Param) {
+		for _, name := range sortedParams(params) {
+			if params[name] == nil || params[name].Pattern == "" {
+				continue
+			}
+			if _, err := regexp.Compile(params[name].Pattern); err != nil {
+				errs = append(errs, fmt.Sprintf("%sparam `%s` pattern regex `%s` : %s", prefix, name, params[name].Pattern, err.Error()))
+			}
+		}
+	}
+	checkParams("", config.Params)
+	check := func(kind string, fragments map[string]*Config) {
+		for _, name := range sortedNames(fragments) {
+			if fragments[name] == nil {
+				continue
+			}
+			if _, err := parseDeniedTemplate(fragments[name].DeniedTemplate); err != nil {
+				errs = append(errs, fmt.Sprintf("%s `%s` %s", kind, name, err.Error()))
+			}
+			checkParams(fmt.Sprintf("%s `%s` ", kind, name), fragments[name].Params)
+			for _, allowedCmd := range fragments[name].AllowedCmd {
+				_, cmdErrs := compileCmd(allowedCmd)
+				for _, e := range cmdErrs {
+					errs = append(errs, fmt.Sprintf("%s `%s` %s", kind, name, e))
+				}
+			}
+		}
+	}
+	check("profile", config.Profiles)
+	check("keyTag", config.KeyTags)
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Tags returns the sorted names of the keyTags of the config
+func (config *Config) Tags() []string {
+	return sortedNames(config.KeyTags)
+}
+
+// compile builds the compiledCmd list of the (merged) config
+// an error is returned if any regex does not compile, so the config can not fail open
+func (config *Config) compile() ([]*compiledCmd, error) {
+	var errs []string
+	cmds := make([]*compiledCmd, 0, len(config.AllowedCmd))
+	for _, allowedCmd := range config.AllowedCmd {
+		c, cmdErrs := compileCmd(allowedCmd)
+		errs = append(errs, cmdErrs...)
+		cmds = append(cmds, c)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return cmds, nil
+}
+
+// tagPatterns sets the keyTag which added each args regex of the compiled cmds
+// of the config merged with tags, the last keyTag with the regex for the cmd wins
+func (config *Config) tagPatterns(cmds []*compiledCmd, tags []string) {
+	tagOf := func(command string, p *pattern, list func(c *Cmd) []string) {
+		for i := len(tags) - 1; i >= 0; i-- {
+			tagConfig := config.KeyTags[tags[i]]
+			if tagConfig == nil {
+				continue
+			}
+			for _, c := range tagConfig.AllowedCmd {
+				if c.Command != command {
+					continue
+				}
+				for _, s := range list(c) {
+					if s == p.String() {
+						p.tag = tags[i]
+						return
+					}
+				}
+			}
+		}
+	}
+	allowed := func(c *Cmd) []string {
+		if c.Args == nil {
+			return nil
+		}
+		return c.Args.Allowed
+	}
+	forbidden := func(c *Cmd) []string {
+		if c.Args == nil {
+			return nil
+		}
+		return c.Args.Forbidden
+	}
+	mustMatch := func(c *Cmd) []string { return c.MustMatch }
+	for _, c := range cmds {
+		for i := range c.allowed {
+			tagOf(c.Command, &c.allowed[i], allowed)
+		}
+		for i := range c.forbidden {
+			tagOf(c.Command, &c.forbidden[i], forbidden)
+		}
+		for i := range c.mustMatch {
+			tagOf(c.Command, &c.mustMatch[i], mustMatch)
+		}
+	}
+}
+
+// compileCmd compiles all the regex of an allowed cmd
+// replace rules are sorted by search regex so they are always applied in the same order
+// it returns the compiledCmd and a description of each invalid regex
+func compileCmd(allowedCmd *Cmd) (*compiledCmd, []string) {
+	var errs []string
+	compileOne := func(kind string, pattern string) *regexp.Regexp {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("command `%s` %s regex `%s` : %s", allowedCmd.Command, kind, pattern, err.Error()))
+		}
+		return re
+	}
+	compileAll := func(kind string, patterns []string) []pattern {
+		var compiled []pattern
+		for _, p := range patterns {
+			if re := compileOne(kind, p); re != nil {
+				compiled = append(compiled, pattern{Regexp: re})
+			}
+		}
+		return compiled
+	}
+	c := &compiledCmd{Cmd: allowedCmd}
+	if allowedCmd.Args != nil {
+		c.forbidden = compileAll("forbidden", allowedCmd.Args.Forbidden)
+		// a non nil allowed list restricts the args even if empty
+		if allowedCmd.Args.Allowed != nil {
+			c.allowed = append([]pattern{}, compileAll("allowed", allowedCmd.Args.Allowed)...)
+		}
+	}
+	c.mustMatch = compileAll("mustMatch", allowedCmd.MustMatch)
+	for _, search := range sorted.Keys(allowedCmd.Replace) {
+		if re := compileOne("replace", search); re != nil {
+			c.replace = append(c.replace, replaceRule{search: re, replace: allowedCmd.Replace[search]})
+		}
+	}
+	return c, errs
+}
+
+// sortedNames returns the sorted names of the keyTags or profiles m
+func sortedNames(m map[string]*Config) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,128 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// A ReasonCode identifies why a command line is denied
+type ReasonCode string
+
+// Reason codes of a denial
+const (
+	NoCommand         ReasonCode = "NO_COMMAND"
+	CommandNotAllowed ReasonCode = "COMMAND_NOT_ALLOWED"
+	ArgForbidden      ReasonCode = "ARG_FORBIDDEN"
+	ArgNotAllowed     ReasonCode = "ARG_NOT_ALLOWED"
+	MustMatchFailed   ReasonCode = "MUST_MATCH_FAILED"
+	ParseError        ReasonCode = "PARSE_ERROR"
+	ShellNotFound     ReasonCode = "SHELL_NOT_FOUND"
+	ParamInvalid      ReasonCode = "PARAM_INVALID"
+)
+
+// A Denial is the reason why a command line is denied
+// Command is the command as typed, or the allowed cmd once matched
+// Argument is the denied argument, or the whole arguments line for MUST_MATCH_FAILED and PARSE_ERROR
+// Pattern is the regex denying the argument, Tag the keyTag which added it, empty if from the base config
+type Denial struct {
+	Code     ReasonCode `json:"code"`
+	Command  string     `json:"command,omitempty"`
+	Argument string     `json:"argument,omitempty"`
+	Pattern  string     `json:"pattern,omitempty"`
+	Tag      string     `json:"tag,omitempty"`
+	Shell    string     `json:"shell,omitempty"`
+	// Param is the invalid or missing param of a PARAM_INVALID, Argument its value
+	Param string `json:"param,omitempty"`
+	// Variable is the builtin or config variable without value of a PARAM_INVALID
+	Variable string `json:"variable,omitempty"`
+	// Err is the underlying error of a PARSE_ERROR, SHELL_NOT_FOUND or PARAM_INVALID
+	Err error `json:"-"`
+}
+
+// Error returns the denial as a readable message
+func (d *Denial) Error() string {
+	switch d.Code {
+	case NoCommand:
+		return "direct ssh not allowed, you must specify a command"
+	case CommandNotAllowed:
+		return fmt.Sprintf("command `%s` not allowed", d.Command)
+	case ArgForbidden:
+		return fmt.Sprintf("command `%s` argument : `%s` forbidden : regex `%s`", d.Command, d.Argument, d.Pattern)
+	case ArgNotAllowed:
+		return fmt.Sprintf("command `%s` arguments : `%s` not allowed", d.Command, d.Argument)
+	case MustMatchFailed:
+		return fmt.Sprintf("command `%s` arguments : `%s` not matching regex `%s`", d.Command, d.Argument, d.Pattern)
+	case ParseError:
+		// the command line itself did not parse, before any argument was found
+		if d.Argument == "" {
+			return d.Err.Error()
+		}
+		return fmt.Sprintf("unable to parse arguments `%s` : `%s`", d.Argument, d.Err.Error())
+	case ShellNotFound:
+		return fmt.Sprintf("did not found shell `%s` in path : `%s`", d.Shell, d.Err.Error())
+	case ParamInvalid:
+		return d.paramError()
+	}
+	return string(d.Code)
+}
+
+// Unwrap returns the underlying error, if any
+func (d *Denial) Unwrap() error {
+	return d.Err
+}
+
+// A DeniedData is the data given to the deniedTemplate of the config
+// Code, Command, Argument, Pattern, Tag and Shell are the fields of the denial
+type DeniedData struct {
+	*Denial
+	// Reason is the readable message of the denial
+	Reason string
+	// Original is the command line as sent by the client
+	Original string
+	User     string
+	Tags     []string
+	// Allowed are the allowed cmds of the effective config
+	Allowed        []*Cmd
+	SupportContact string
+	HelpText       string
+}
+
+// templateFuncs are the functions available in a deniedTemplate
+var templateFuncs = template.FuncMap{"join": strings.Join}
+
+// parseDeniedTemplate parses a deniedTemplate
+func parseDeniedTemplate(text string) (*template.Template, error) {
+	return template.New("deniedTemplate").Funcs(templateFuncs).Parse(text)
+}
+
+// RenderDenied returns the message of the deniedTemplate of the effective config for a denied decision
+// an empty string is returned if there is no template, a newline is appended to the message if missing
+func (d *Decision) RenderDenied() (string, error) {
+	if d.Reason == nil || d.Config.DeniedTemplate == "" {
+		return "", nil
+	}
+	tmpl, err := parseDeniedTemplate(d.Config.DeniedTemplate)
+	if err != nil {
+		return "", err
+	}
+	data := &DeniedData{
+		Denial:         d.Reason,
+		Reason:         d.Reason.Error(),
+		Original:       d.Request.Command,
+		User:           d.Request.Client.User,
+		Tags:           d.Request.Tags,
+		Allowed:        d.Config.AllowedCmd,
+		SupportContact: d.Config.SupportContact,
+		HelpText:       d.Config.HelpText,
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", err
+	}
+	out := sb.String()
+	if out != "" && !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	return out, nil
+}
@@ -0,0 +1,43 @@
+package policy
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// An Executor runs allowed decisions
+type Executor struct {
+	// Stdin is only given to the allowed cmds accepting stdin
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+	// BeforeRun is called with the command just before it is started, if set
+	BeforeRun func(d *Decision, c *exec.Cmd)
+}
+
+// Run runs the argv of the decision with its environ
+// it returns the exit code of the command, and an error if the decision
+// is not allowed or the command could not be started
+func (e *Executor) Run(d *Decision) (int, error) {
+	if !d.Allowed || len(d.Argv) == 0 {
+		return 1, fmt.Errorf("command `%s` not allowed", d.Request.Command)
+	}
+	c := exec.Command(d.Argv[0], d.Argv[1:]...)
+	c.Env = d.Environ
+	if d.Cmd != nil && d.Cmd.AcceptsStdin() {
+		c.Stdin = e.Stdin
+	}
+	c.Stdout = e.Stdout
+	c.Stderr = e.Stderr
+	if e.BeforeRun != nil {
+		e.BeforeRun(d, c)
+	}
+	if err := c.Run(); err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			return exitError.ExitCode(), nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
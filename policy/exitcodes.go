@@ -0,0 +1,58 @@
+package policy
+
+// Keys of the exitCodes config which are not denial reason codes
+const (
+	// ExitDenied is the exit code of any denial without its own exit code
+	ExitDenied = "DENIED"
+	// ExitConfigError is the exit code when the config can not be loaded
+	ExitConfigError = "CONFIG_ERROR"
+	// ExitInternalError is the exit code when an allowed command can not be started
+	ExitInternalError = "INTERNAL_ERROR"
+)
+
+// defaultExitCodes holds the exit codes used if not set in the config
+// they do not collide with the usual exit codes of the allowed commands
+var defaultExitCodes = map[string]int{
+	ExitDenied:                126,
+	string(CommandNotAllowed): 127,
+	ExitConfigError:           78,
+	ExitInternalError:         125,
+}
+
+// exitCodeKeys are the valid keys of the exitCodes config
+var exitCodeKeys = []string{
+	ExitDenied, ExitConfigError, ExitInternalError,
+	string(NoCommand), string(CommandNotAllowed), string(ArgForbidden), string(ArgNotAllowed),
+	string(MustMatchFailed), string(ParseError), string(ShellNotFound), string(ParamInvalid),
+}
+
+// DefaultExitCode returns the default exit code of key
+func DefaultExitCode(key string) int {
+	if code, ok := defaultExitCodes[key]; ok {
+		return code
+	}
+	return defaultExitCodes[ExitDenied]
+}
+
+// ExitCode returns the exit code of key from the exitCodes config or the defaults
+// key is ExitConfigError, ExitInternalError, ExitDenied or a denial reason code
+// a denial reason code without exit code gets the DENIED exit code of the config if set
+func (config *Config) ExitCode(key string) int {
+	if code, ok := config.ExitCodes[key]; ok {
+		return code
+	}
+	if key != ExitConfigError && key != ExitInternalError {
+		if code, ok := config.ExitCodes[ExitDenied]; ok {
+			return code
+		}
+	}
+	return DefaultExitCode(key)
+}
+
+// ExitCode returns the exit code of a denied decision from its effective config
+func (d *Decision) ExitCode() int {
+	if d.Reason == nil {
+		return 0
+	}
+	return d.Config.ExitCode(string(d.Reason.Code))
+}
@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of a config file
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// FormatOf returns the format of a config file from its extension, yaml if not .json nor .toml
+func FormatOf(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+// Unmarshal decodes the config data in format into v, as yaml.Unmarshal does for yaml
+func Unmarshal(data []byte, format string, v interface{}) error {
+	doc, err := decodeNode(data, format)
+	if err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	return doc.Decode(v)
+}
+
+// decodeNode returns the yaml document node of the config data in format
+// json and toml documents are decoded as generic values and encoded as yaml nodes, so every format
+// is decoded and validated the same way, their nodes have no position and their keys are sorted
+func decodeNode(data []byte, format string) (*yaml.Node, error) {
+	var v interface{}
+	switch format {
+	case FormatYAML, "":
+		var doc yaml.Node
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		return &doc, nil
+	case FormatJSON:
+		if len(bytes.TrimSpace(data)) == 0 {
+			return &yaml.Node{Kind: yaml.DocumentNode}, nil
+		}
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, jsonError(data, err)
+		}
+	case FormatTOML:
+		var table map[string]interface{}
+		if err := toml.Unmarshal(data, &table); err != nil {
+			return nil, tomlError(err)
+		}
+		if len(table) == 0 {
+			return &yaml.Node{Kind: yaml.DocumentNode}, nil
+		}
+		v = table
+	default:
+		return nil, fmt.Errorf("unknown config format `%s`, must be %s, %s or %s", format, FormatYAML, FormatJSON, FormatTOML)
+	}
+	var node yaml.Node
+	if err := node.Encode(v); err != nil {
+		return nil, fmt.Errorf("%s: %s", format, err.Error())
+	}
+	return &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&node}}, nil
+}
+
+// jsonError returns the json decoding error err with the position of a syntax error
+func jsonError(data []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return fmt.Errorf("json: %s", err.Error())
+	}
+	// the offset is after the invalid character
+	offset := int(syntaxErr.Offset) - 1
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(data) {
+		offset = len(data)
+	}
+	lead := data[:offset]
+	line, column := bytes.Count(lead, []byte{'\n'})+1, utf8.RuneCount(lead[bytes.LastIndexByte(lead, '\n')+1:])+1
+	return fmt.Errorf("json: line %d column %d: %s", line, column, err.Error())
+}
+
+// tomlError returns the toml decoding error err with its position
+func tomlError(err error) error {
+	var decodeErr *toml.DecodeError
+	if !errors.As(err, &decodeErr) {
+		return err
+	}
+	line, column := decodeErr.Position()
+	return fmt.Errorf("toml: line %d column %d: %s", line, column, strings.TrimPrefix(decodeErr.Error(), "toml: "))
+}
@@ -0,0 +1,161 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Key maps a public key authenticating ssh clients to keyTags, so authcmd needs no tag in authorized_keys
+type Key struct {
+	// Key is the SHA256 fingerprint of the key as printed by ssh-keygen -l, or the public key `type base64 [comment]`
+	Key         string   `yaml:"key,omitempty" json:"key,omitempty"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Tags        []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+}
+
+// An AuthKey is a public key which authenticated the ssh client, as listed in the SSH_USER_AUTH file
+type AuthKey struct {
+	Type string
+	// Fingerprint is the SHA256 fingerprint of the key, e.g. SHA256:uNiVztksCsDhcc0u9e8BujQXVUpKZIDTMczCvj3tD2s
+	// the fingerprint of a certificate is the one of the certified key, as printed by ssh-keygen -l
+	Fingerprint string
+	// Cert is the certificate of the key, nil if the key is not a certificate
+	Cert *Certificate
+}
+
+// Clone returns a deep copy of the key
+func (key *Key) Clone() *Key {
+	c := *key
+	c.Tags = cloneSlice(key.Tags)
+	return &c
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key of a Key, the key itself if it is a fingerprint
+func (key *Key) Fingerprint() (string, error) {
+	if strings.HasPrefix(key.Key, "SHA256:") {
+		if sum, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(key.Key, "SHA256:")); err != nil || len(sum) != sha256.Size {
+			return "", fmt.Errorf("fingerprint `%s` is not a SHA256 digest in base64", key.Key)
+		}
+		return key.Key, nil
+	}
+	fields := strings.Fields(key.Key)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("`%s` is neither a SHA256 fingerprint nor a public key `type base64 [comment]`", key.Key)
+	}
+	authKey, err := parseAuthKey(fields[0], fields[1])
+	if err != nil {
+		return "", err
+	}
+	return authKey.Fingerprint, nil
+}
+
+// ParseUserAuth returns the public keys which authenticated the ssh client
+// from the content of the SSH_USER_AUTH file written by sshd with ExposeAuthInfo
+// each line is an authentication method, e.g. `publickey ssh-ed25519 AAAA...`, the other methods are ignored
+func ParseUserAuth(data []byte) ([]AuthKey, error) {
+	var keys []AuthKey
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "publickey" {
+			continue
+		}
+		key, err := parseAuthKey(fields[1], fields[2])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseAuthKey returns the key of type keyType encoded in base64 in the ssh wire format
+func parseAuthKey(keyType, encoded string) (AuthKey, error) {
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return AuthKey{}, fmt.Errorf("public key `%s` is not base64 : %s", encoded, err.Error())
+	}
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil || key.Type() != keyType {
+		return AuthKey{}, fmt.Errorf("public key `%s` is not a `%s` key", encoded, keyType)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return AuthKey{Type: keyType, Fingerprint: ssh.FingerprintSHA256(key)}, nil
+	}
+	c, err := newCertificate(cert)
+	if err != nil {
+		return AuthKey{}, err
+	}
+	// the fingerprint of a certificate is the one of the certified key
+	return AuthKey{Type: keyType, Fingerprint: ssh.FingerprintSHA256(cert.Key), Cert: c}, nil
+}
+
+// checkKeys returns an error listing every key of the config which is neither a fingerprint nor a public key
+// and every certificate rule with an invalid CA fingerprint or regex
+func (config *Config) checkKeys() error {
+	var errs []string
+	for i, key := range config.Keys {
+		if _, err := key.Fingerprint(); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid key in `keys[%d]` : %s", i, err.Error()))
+		}
+	}
+	for i, rule := range config.Certificates {
+		if err := rule.check(); err != nil {
+			errs = append(errs, fmt.Sprintf("invalid rule in `certificates[%d]` : %s", i, err.Error()))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// AuthTags returns the keyTags of the keys which authenticated the ssh client, in order :
+// the tags of the keys of the config, then of the certificate rules matching a certificate
+// a certificate not valid now gives no keyTag
+func (p *Policy) AuthTags(authKeys []AuthKey) []string {
+	var tags []string
+	for _, authKey := range authKeys {
+		keyTags, _ := p.authKeyTags(authKey, time.Now())
+		for _, tag := range keyTags {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+// authKeyTags returns the keyTags of a key which authenticated the ssh client
+// an error is returned for a certificate not valid at the time t
+func (p *Policy) authKeyTags(authKey AuthKey, t time.Time) ([]string, error) {
+	if authKey.Cert != nil {
+		if err := authKey.Cert.Valid(t); err != nil {
+			return nil, err
+		}
+	}
+	var tags []string
+	add := func(keyTags []string) {
+		for _, tag := range keyTags {
+			if !contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	for _, key := range p.config.Keys {
+		if keyFingerprint, err := key.Fingerprint(); err == nil && keyFingerprint == authKey.Fingerprint {
+			add(key.Tags)
+		}
+	}
+	if authKey.Cert != nil {
+		for _, rule := range p.config.Certificates {
+			add(rule.tags(authKey.Cert))
+		}
+	}
+	return tags, nil
+}
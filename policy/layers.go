@@ -0,0 +1,254 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DropInDir is the directory next to a config file whose files are merged after it
+const DropInDir = "authcmd.d"
+
+// A Layer is a config file with its format : yaml, json or toml, from the file extension if empty
+type Layer struct {
+	File   string
+	Format string
+}
+
+// format returns the format of the layer file
+func (l Layer) format() string {
+	if l.Format != "" {
+		return l.Format
+	}
+	return FormatOf(l.File)
+}
+
+// A Source is a config file merged in a policy, with its own config
+// File is empty for a config loaded from bytes
+type Source struct {
+	File   string
+	Config *Config
+}
+
+// LayerFiles returns the config files of a layer in merge order : the file, the files it includes
+// recursively, then the files of its authcmd.d drop-in directory in lexical order, with their includes
+// The format of every file is set
+func LayerFiles(layer Layer) ([]Layer, error) {
+	data, err := ioutil.ReadFile(layer.File)
+	if err != nil {
+		return nil, &ConfigError{File: layer.File, Err: err}
+	}
+	files, err := includedFiles(layer, data, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	dropIns, err := dropInFiles(filepath.Join(filepath.Dir(layer.File), DropInDir))
+	if err != nil {
+		return nil, &ConfigError{File: layer.File, Err: err}
+	}
+	for _, dropIn := range dropIns {
+		dropInData, err := ioutil.ReadFile(dropIn.File)
+		if err != nil {
+			return nil, &ConfigError{File: dropIn.File, Err: err}
+		}
+		included, err := includedFiles(dropIn, dropInData, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, included...)
+	}
+	return files, nil
+}
+
+// includedFiles returns the layer followed by the files included by its data, recursively
+// include paths are relative to the directory of the file and may be glob patterns
+// visiting holds the files being included, to detect a cycle
+func includedFiles(layer Layer, data []byte, visiting map[string]bool) ([]Layer, error) {
+	layer.Format = layer.format()
+	var includes struct {
+		Include []string `yaml:"include"`
+	}
+	// a file which does not decode is reported when it is loaded
+	if Unmarshal(data, layer.Format, &includes) != nil {
+		return []Layer{layer}, nil
+	}
+	key := layer.File
+	if abs, err := filepath.Abs(layer.File); err == nil && layer.File != "" {
+		key = abs
+	}
+	if visiting[key] {
+		return nil, &ConfigError{File: layer.File, Invalid: true, Err: fmt.Errorf("include cycle on file `%s`", layer.File)}
+	}
+	visiting[key] = true
+	defer delete(visiting, key)
+
+	files := []Layer{layer}
+	for _, include := range includes.Include {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(layer.File), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, &ConfigError{File: layer.File, Invalid: true, Err: fmt.Errorf("include `%s` : %s", include, err.Error())}
+		}
+		// a pattern may match no file, a file must exist
+		if len(matches) == 0 && !strings.ContainsAny(include, `*?[`) {
+			return nil, &ConfigError{File: layer.File, Invalid: true, Err: fmt.Errorf("included file `%s` not found", include)}
+		}
+		for _, match := range matches {
+			matchData, err := ioutil.ReadFile(match)
+			if err != nil {
+				return nil, &ConfigError{File: match, Err: err}
+			}
+			included, err := includedFiles(Layer{File: match}, matchData, visiting)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, included...)
+		}
+	}
+	return files, nil
+}
+
+// dropInFiles returns the config files of the dir in lexical order, by their extension
+// hidden files and other extensions, like backup files, are ignored
+func dropInFiles(dir string) ([]Layer, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []Layer
+	for _, entry := range entries {
+		name := entry.Name()
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".yml", ".yaml", ".json", ".toml":
+			if !entry.IsDir() && !strings.HasPrefix(name, ".") {
+				files = append(files, Layer{File: filepath.Join(dir, name)})
+			}
+		}
+	}
+	return files, nil
+}
+
+// loadFiles reads the config files and merges them in order into a policy
+// data is the content of the first file if not nil, file is the file reported by the errors of the merged config
+// A file is validated if it is strict or if any file sets strict
+func loadFiles(file string, files []Layer, data []byte) (*Policy, error) {
+	sources := make([]*Source, 0, len(files))
+	datas := make([][]byte, 0, len(files))
+	for i, f := range files {
+		fileData := data
+		if i > 0 || data == nil {
+			var err error
+			if fileData, err = ioutil.ReadFile(f.File); err != nil {
+				return nil, &ConfigError{File: f.File, Err: err}
+			}
+		}
+		config := &Config{}
+		if err := Unmarshal(fileData, f.format(), config); err != nil {
+			// a strict file is validated to report every issue with its position
+			if issuesErr := validateFile(f, fileData, config.Strict, nil); issuesErr != nil {
+				return nil, issuesErr
+			}
+			return nil, &ConfigError{File: f.File, Err: err}
+		}
+		// a null entry would be used by the merge below
+		if err := config.checkEntries(); err != nil {
+			return nil, &ConfigError{File: f.File, Invalid: true, Err: err}
+		}
+		sources = append(sources, &Source{File: f.File, Config: config})
+		datas = append(datas, fileData)
+	}
+
+	merged := sources[0].Config.Clone()
+	for _, source := range sources[1:] {
+		merged.mergeLayer(source.Config)
+	}
+	variables := merged.VariableNames()
+	for i, source := range sources {
+		if err := validateFile(files[i], datas[i], merged.Strict, variables); err != nil {
+			return nil, err
+		}
+		if err := source.Config.checkRegex(); err != nil {
+			return nil, &ConfigError{File: source.File, Invalid: true, Err: err}
+		}
+	}
+	// the includes, removed cmds and merge strategies are applied
+	merged.Include = nil
+	merged.resetMerge()
+	p, err := newPolicy(file, merged)
+	if err != nil {
+		return nil, err
+	}
+	p.sources = sources
+	return p, nil
+}
+
+// validateFile returns the issues of the file as a ConfigError if strict is set
+// variables are the params and variables declared by the merged files
+func validateFile(file Layer, data []byte, strict *bool, variables []string) error {
+	if strict == nil || !*strict {
+		return nil
+	}
+	issues := ValidateLayer(data, file.format(), variables)
+	if len(issues) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		msgs = append(msgs, issue.String())
+	}
+	return &ConfigError{File: file.File, Invalid: true, Err: fmt.Errorf("%s", strings.Join(msgs, ", "))}
+}
+
+// mergeLayer merges the config of a later config file : its settings and allowed cmds as mergeConfig does
+// for a keyTag, and its profiles and keyTags with the ones of the same name, as mergeFragment does
+// its keys and certificate rules are added after the existing ones
+// layer is not modified
+func (config *Config) mergeLayer(layer *Config) {
+	config.mergeConfig(layer)
+	for _, key := range layer.Keys {
+		config.Keys = append(config.Keys, key.Clone())
+	}
+	for _, rule := range layer.Certificates {
+		config.Certificates = append(config.Certificates, rule.Clone())
+	}
+	config.Profiles = mergeFragments(config.Profiles, layer.Profiles)
+	config.KeyTags = mergeFragments(config.KeyTags, layer.KeyTags)
+}
+
+// mergeFragments merges the keyTags or profiles of a later config file into the ones of the same name
+func mergeFragments(fragments, layerFragments map[string]*Config) map[string]*Config {
+	for name, layerFragment := range layerFragments {
+		if fragments == nil {
+			fragments = map[string]*Config{}
+		}
+		existing := fragments[name]
+		switch {
+		case existing == nil && layerFragment != nil:
+			existing = &Config{}
+			existing.mergeFragment(layerFragment)
+			fragments[name] = existing
+		case existing == nil:
+			fragments[name] = nil
+		case layerFragment != nil:
+			existing.mergeFragment(layerFragment)
+		}
+	}
+	return fragments
+}
+
+// Sources returns the config files merged in the policy in merge order, with their own config
+func (p *Policy) Sources() []Source {
+	sources := make([]Source, 0, len(p.sources))
+	for _, source := range p.sources {
+		sources = append(sources, Source{File: source.File, Config: source.Config.Clone()})
+	}
+	return sources
+}
@@ -0,0 +1,110 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/sorted"
+)
+
+// A Param declares a parameter given to authcmd as a `key=value` tag, usable as ${key}
+// in the command, args regex, mustMatch, replace rules and setEnvVars of the allowed cmds
+// The value must be one of Values or fully match Pattern, a param without both accepts no value
+type Param struct {
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Pattern     string   `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Values      []string `yaml:"values,omitempty" json:"values,omitempty"`
+	// Default is the value of the param if not given
+	Default string `yaml:"default,omitempty" json:"default,omitempty"`
+}
+
+// paramName matches the key of a `key=value` tag
+var paramName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SplitTags returns the keyTags and the `key=value` params of the tags given to authcmd, in order
+func SplitTags(tags []string) ([]string, map[string]string) {
+	var names []string
+	var params map[string]string
+	for _, tag := range tags {
+		if i := strings.Index(tag, "="); i > 0 && paramName.MatchString(tag[:i]) {
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[tag[:i]] = tag[i+1:]
+			continue
+		}
+		names = append(names, tag)
+	}
+	return names, params
+}
+
+// Clone returns a deep copy of the param
+func (param *Param) Clone() *Param {
+	c := *param
+	c.Values = cloneSlice(param.Values)
+	return &c
+}
+
+// check returns whether the value is allowed for the param
+func (param *Param) check(value string) bool {
+	if contains(param.Values, value) {
+		return true
+	}
+	if param.Pattern == "" {
+		return false
+	}
+	re, err := regexp.Compile("^(?:" + param.Pattern + ")$")
+	return err == nil && re.MatchString(value)
+}
+
+// paramValues returns the value of every declared param from the given params or their default
+// a denial is returned for an undeclared param or a value not allowed
+func (config *Config) paramValues(params map[string]string, tr *Trace) (map[string]string, *Denial) {
+	for _, name := range sorted.Keys(params) {
+		param := config.Params[name]
+		if param == nil {
+			return nil, &Denial{Code: ParamInvalid, Param: name, Err: errors.New("not declared")}
+		}
+		if !param.check(params[name]) {
+			return nil, &Denial{Code: ParamInvalid, Param: name, Argument: params[name], Pattern: param.Pattern}
+		}
+	}
+	values := map[string]string{}
+	for name, param := range config.Params {
+		if value, ok := params[name]; ok {
+			values[name] = value
+		} else if param != nil && param.Default != "" {
+			values[name] = param.Default
+		}
+	}
+	for _, name := range sorted.Keys(values) {
+		tr.add(StepParams, "param `%s` = `%s`", name, values[name])
+	}
+	return values, nil
+}
+
+// paramError returns the message of a PARAM_INVALID denial
+func (d *Denial) paramError() string {
+	switch {
+	case d.Variable != "":
+		return fmt.Sprintf("command `%s` needs variable `%s`", d.Command, d.Variable)
+	case d.Command != "":
+		return fmt.Sprintf("command `%s` needs param `%s`", d.Command, d.Param)
+	case d.Err != nil:
+		return fmt.Sprintf("param `%s` %s", d.Param, d.Err.Error())
+	}
+	return fmt.Sprintf("param `%s` value `%s` not allowed", d.Param, d.Argument)
+}
+
+// sortedParams returns the sorted names of the params
+func sortedParams(params map[string]*Param) []string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
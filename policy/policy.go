@@ -0,0 +1,615 @@
+/*
+Package policy is the authcmd policy engine : it loads an authcmd.yml config
+and evaluates ssh command lines against it, without running anything.
+
+A Policy is immutable once loaded and safe for concurrent use :
+
+	p, err := policy.Load("authcmd.yml")
+	d, err := p.Evaluate(policy.Request{Command: "ls -l", Tags: []string{"ops"}, Env: os.Environ()})
+	if d.Allowed {
+		code, err := (&policy.Executor{Stdout: os.Stdout, Stderr: os.Stderr}).Run(d)
+	}
+*/
+package policy
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Policy is a loaded config, evaluating requests
+// The config merged with each list of keyTags is compiled once and cached
+type Policy struct {
+	config *Config
+	// sources are the config files merged in config
+	sources []*Source
+	// declared are the names usable as ${name} in the config and its keyTags
+	declared map[string]bool
+
+	mu     sync.Mutex
+	merged map[string]*effective
+}
+
+// An effective is the config merged with a list of keyTags, with its compiled cmds
+type effective struct {
+	config *Config
+	cmds   []*compiledCmd
+	// variables is true if the config may use variables, replaced for each request
+	variables bool
+	// declared are the names usable as ${name}, declared by this config or not
+	declared map[string]bool
+}
+
+// A ConfigError is an error loading a config file
+// File is empty for a config loaded from bytes
+type ConfigError struct {
+	File string
+	// Invalid is true if the config was read but is not valid
+	Invalid bool
+	Err     error
+}
+
+// Error returns the error with the config file name
+func (e *ConfigError) Error() string {
+	name := "config"
+	if e.File != "" {
+		name = fmt.Sprintf("config file `%s`", e.File)
+	}
+	if e.Invalid {
+		return fmt.Sprintf("invalid %s : %s", name, e.Err.Error())
+	}
+	return fmt.Sprintf("cannot read %s got error `%s`", name, e.Err.Error())
+}
+
+// Unwrap returns the underlying error
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// Load reads and parses the config file, in the format of its extension,
+// merged with the files it includes and the files of its authcmd.d drop-in directory
+func Load(file string) (*Policy, error) {
+	return LoadLayers(Layer{File: file})
+}
+
+// LoadFormat loads the config file as Load does, in format : yaml, json or toml
+func LoadFormat(file, format string) (*Policy, error) {
+	return LoadLayers(Layer{File: file, Format: format})
+}
+
+// LoadLayers loads the config files of the layers and merges them in order, each with its
+// includes and drop-in files (see LayerFiles), e.g. a system wide file then the file of the user
+// A later file overrides the settings of the earlier ones and extends their allowed cmds and keyTags,
+// as a keyTag does
+func LoadLayers(layers ...Layer) (*Policy, error) {
+	if len(layers) == 0 {
+		return nil, &ConfigError{Err: fmt.Errorf("no config file")}
+	}
+	var files []Layer
+	for _, layer := range layers {
+		layerFiles, err := LayerFiles(layer)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, layerFiles...)
+	}
+	return loadFiles(layers[len(layers)-1].File, files, nil)
+}
+
+// Parse parses the yaml data of a config
+// included files are relative to the current directory
+func Parse(data []byte) (*Policy, error) {
+	return ParseFormat(data, FormatYAML)
+}
+
+// ParseFormat parses the data of a config in format : yaml, json or toml
+func ParseFormat(data []byte, format string) (*Policy, error) {
+	files, err := includedFiles(Layer{Format: format}, data, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+	return loadFiles("", files, data)
+}
+
+// New returns the policy of a config built in code
+// the config is copied, later changes to it are ignored
+func New(config *Config) (*Policy, error) {
+	p, err := newPolicy("", config)
+	if err != nil {
+		return nil, err
+	}
+	p.sources = []*Source{{Config: config.Clone()}}
+	return p, nil
+}
+
+// newPolicy returns the policy of the config of file
+// every regex is checked, even those of keyTags, so a config can not fail open
+func newPolicy(file string, config *Config) (*Policy, error) {
+	if err := config.checkEntries(); err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	if err := config.checkRegex(); err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	if err := config.checkKeys(); err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	declared := declaredVariables(config.VariableNames())
+	if err := config.checkVariables(declared); err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	p := &Policy{config: config.Clone(), declared: declared, merged: map[string]*effective{}}
+	tags, err := config.resolveExtends()
+	if err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	// ${TAG} is the name of the keyTag, even in the profiles it extends
+	interpolateTag(tags)
+	p.config.KeyTags = tags
+	if _, err := p.effective(nil); err != nil {
+		return nil, &ConfigError{File: file, Invalid: true, Err: err}
+	}
+	return p, nil
+}
+
+// Base returns a copy of the config, without any keyTag merged
+// its keyTags are merged with the profiles and keyTags they extend
+func (p *Policy) Base() *Config {
+	return p.config.Clone()
+}
+
+// Effective returns a copy of the config merged with the keyTags, in order
+// unknown keyTags are ignored
+func (p *Policy) Effective(tags []string) (*Config, error) {
+	e, err := p.effective(tags)
+	if err != nil {
+		return nil, err
+	}
+	return e.config.Clone(), nil
+}
+
+// Interpolated returns a copy of the config merged with the keyTags of the request, with the params
+// and variables replaced as Evaluate does, e.g. for the commands shown to the client
+// the allowed cmds using a variable without value are left out, as they are denied
+// the denial is returned as error if a param of the request is not valid
+func (p *Policy) Interpolated(req Request) (*Config, error) {
+	tags, params := SplitTags(req.Tags)
+	e, err := p.effective(tags)
+	if err != nil {
+		return nil, err
+	}
+	e, denial, err := e.withVariables(req, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	if denial != nil {
+		return nil, denial
+	}
+	config := e.config.Clone()
+	config.AllowedCmd = nil
+	for i, c := range e.cmds {
+		if c.missing == "" {
+			config.AllowedCmd = append(config.AllowedCmd, e.config.AllowedCmd[i].Clone())
+		}
+	}
+	return config, nil
+}
+
+// effective returns the compiled config merged with the keyTags, from the cache if already merged
+func (p *Policy) effective(tags []string) (*effective, error) {
+	var found []string
+	for _, tag := range tags {
+		if _, exists := p.config.KeyTags[tag]; exists {
+			found = append(found, tag)
+		}
+	}
+	key := strings.Join(found, "\x00")
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.merged[key]; ok {
+		return e, nil
+	}
+	merged := p.config.Clone()
+	merged.KeyTags = nil
+	merged.Profiles = nil
+	merged.Keys = nil
+	merged.Certificates = nil
+	for _, tag := range found {
+		if tagConfig := p.config.KeyTags[tag]; tagConfig != nil {
+			merged.mergeConfig(tagConfig)
+		}
+	}
+	merged.resetMerge()
+	cmds, err := merged.compile()
+	if err != nil {
+		return nil, err
+	}
+	p.config.tagPatterns(cmds, found)
+	e := &effective{config: merged, cmds: cmds, variables: merged.usesVariables(), declared: p.declared}
+	p.merged[key] = e
+	return e, nil
+}
+
+// tagFiles returns the quoted files of the sources defining the keyTag
+func (p *Policy) tagFiles(tag string) []string {
+	var files []string
+	for _, source := range p.sources {
+		if _, exists := source.Config.KeyTags[tag]; exists {
+			files = append(files, "`"+source.File+"`")
+		}
+	}
+	return files
+}
+
+// A Request is a command line to evaluate, as received by a ssh forced command
+type Request struct {
+	// Command is the original command line, from SSH_ORIGINAL_COMMAND
+	Command string
+	// Tags are the keyTags given to authcmd in the authorized_keys file
+	// and its `key=value` params (see SplitTags)
+	Tags []string
+	// Env is the env the command would be run with, as returned by os.Environ
+	Env []string
+	// Client is the ssh client sending the command
+	Client Client
+	// Trace records every step of the evaluation in the decision if true
+	// steps are always recorded if the effective config sets logDecisions to trace
+	Trace bool
+}
+
+// A Client is the user and address of the ssh client of a request
+type Client struct {
+	User string
+	IP   string
+	Port string
+	// Keys are the public keys which authenticated the client, from the SSH_USER_AUTH file
+	// their keyTags are not added to the request by Evaluate, see AuthTags
+	Keys []AuthKey
+}
+
+// A Decision is the result of the evaluation of a request
+type Decision struct {
+	Request Request
+	Allowed bool
+	// Cmd is the allowed cmd matching the command, nil if none
+	Cmd *Cmd
+	// Argv is the final command to run, after replace and env expansion
+	Argv []string
+	// Env holds the env vars set by the config, Environ the full env of the command
+	Env     []string
+	Environ []string
+	// Reason is the reason of the denial
+	Reason *Denial
+	// Learned is the denial ignored by the learn mode
+	Learned *Denial
+	// Trace holds the steps of the evaluation if requested
+	Trace *Trace
+	// Config is the effective config of the request, shared and not to be modified
+	Config *Config
+}
+
+// Evaluate checks the request against the config merged with its keyTags, without running anything
+// it returns the decision with the matched allowed cmd and the final argv and env if allowed
+// an error is returned only if the effective config can not be built
+func (p *Policy) Evaluate(req Request) (*Decision, error) {
+	tags, params := SplitTags(req.Tags)
+	e, err := p.effective(tags)
+	if err != nil {
+		return nil, err
+	}
+	d := &Decision{Request: req, Config: e.config}
+	if req.Trace || e.config.LogDecisions == "trace" {
+		d.Trace = &Trace{}
+	}
+	// the files are only traced if there are several
+	if len(p.sources) > 1 {
+		for _, source := range p.sources {
+			d.Trace.add(StepConfig, "file `%s` merged", source.File)
+		}
+	}
+	for _, authKey := range req.Client.Keys {
+		name := fmt.Sprintf("key `%s`", authKey.Fingerprint)
+		if authKey.Cert != nil {
+			name = fmt.Sprintf("certificate `%s` of key `%s`", authKey.Cert.KeyID, authKey.Fingerprint)
+		}
+		if authTags, err := p.authKeyTags(authKey, time.Now()); err != nil {
+			d.Trace.add(StepTags, "%s ignored : %s", name, err.Error())
+		} else if len(authTags) > 0 {
+			d.Trace.add(StepTags, "%s mapped to keyTags `%s`", name, strings.Join(authTags, "`, `"))
+		} else {
+			d.Trace.add(StepTags, "%s not mapped to any keyTag", name)
+		}
+	}
+	for _, tag := range tags {
+		if _, exists := p.config.KeyTags[tag]; exists && len(p.sources) > 1 {
+			d.Trace.add(StepTags, "keyTag `%s` merged from %s", tag, strings.Join(p.tagFiles(tag), ", "))
+		} else if exists {
+			d.Trace.add(StepTags, "keyTag `%s` merged", tag)
+		} else {
+			d.Trace.add(StepTags, "keyTag `%s` not found in config, ignored", tag)
+		}
+		if tagConfig := p.config.KeyTags[tag]; tagConfig != nil && len(tagConfig.Extends) > 0 {
+			d.Trace.add(StepTags, "keyTag `%s` extends `%s`", tag, strings.Join(tagConfig.Extends, "`, `"))
+		}
+	}
+	// the params are validated and the variables replaced in the effective config of the keyTags
+	if e, d.Reason, err = e.withVariables(req, params, d.Trace); err != nil {
+		return nil, err
+	}
+	if e != nil {
+		d.Config = e.config
+		e.evaluate(d)
+	}
+	if d.Allowed {
+		d.Trace.add(StepDecision, "allowed, running %q", d.Argv)
+	} else {
+		d.Trace.add(StepDecision, "denied : %s", d.Reason.Error())
+	}
+	return d, nil
+}
+
+// evaluate does the evaluation of the decision request for Evaluate
+func (e *effective) evaluate(d *Decision) {
+	originalCmd, tr := d.Request.Command, d.Trace
+	if len(strings.TrimSpace(originalCmd)) <= 0 {
+		d.Reason = &Denial{Code: NoCommand}
+		return
+	}
+	parsedOriginalCmd, err := ParseCommandLine(originalCmd)
+	if err != nil {
+		d.Reason = &Denial{Code: ParseError, Err: err}
+		return
+	}
+	originalArgs := strings.TrimPrefix(strings.TrimLeft(originalCmd, " \t"), parsedOriginalCmd[0])
+
+	allowedCmd := e.matchCmd(parsedOriginalCmd[0], tr)
+	if allowedCmd == nil {
+		d.Reason = &Denial{Code: CommandNotAllowed, Command: parsedOriginalCmd[0]}
+		return
+	}
+	d.Cmd = allowedCmd.Cmd
+	if allowedCmd.missing != "" {
+		if _, isParam := e.config.Params[allowedCmd.missing]; isParam {
+			d.Reason = &Denial{Code: ParamInvalid, Command: allowedCmd.Command, Param: allowedCmd.missing}
+		} else {
+			d.Reason = &Denial{Code: ParamInvalid, Command: allowedCmd.Command, Variable: allowedCmd.missing}
+		}
+		return
+	}
+	if d.Reason = checkArgs(allowedCmd, originalArgs, parsedOriginalCmd[1:], tr); d.Reason != nil {
+		return
+	}
+	for _, rule := range allowedCmd.replace {
+		replaced := rule.search.ReplaceAllString(originalArgs, rule.replace)
+		tr.add(StepReplace, "regex `%s` by `%s` : `%s` -> `%s`", rule.search, rule.replace, originalArgs, replaced)
+		originalArgs = replaced
+	}
+	var envMap map[string]string
+	d.Env, d.Environ, envMap = e.config.setEnvVars(allowedCmd.Cmd, d.Request.Env)
+	for _, kv := range d.Env {
+		tr.add(StepEnv, "set %s", kv)
+	}
+	if e.config.ExpandEnvVars != nil && *e.config.ExpandEnvVars {
+		expanded := os.Expand(originalArgs, func(key string) string { return envMap[key] })
+		tr.add(StepEnv, "expanded env vars : `%s` -> `%s`", originalArgs, expanded)
+		originalArgs = expanded
+	}
+	if e.config.UseShell != "" {
+		shell := e.config.UseShell
+		if shell == "default" {
+			if envShell, ok := envMap["SHELL"]; ok {
+				shell = envShell
+			}
+		}
+		shellPath, err := exec.LookPath(shell)
+		if err != nil {
+			d.Reason = &Denial{Code: ShellNotFound, Command: allowedCmd.Command, Shell: shell, Err: err}
+			return
+		}
+		tr.add(StepShell, "running with shell `%s`", shellPath)
+		d.Argv = []string{shellPath, "-c", allowedCmd.Command + " " + originalArgs}
+	} else {
+		newParsedCmd, err := ParseCommandLine(allowedCmd.Command + " " + originalArgs)
+		if err != nil {
+			d.Reason = &Denial{Code: ParseError, Command: allowedCmd.Command, Argument: originalArgs, Err: err}
+			return
+		}
+		d.Argv = append([]string{allowedCmd.Command}, newParsedCmd[1:]...)
+	}
+	d.Allowed = true
+}
+
+// matchCmd returns the allowed cmd of the config matching the command name, nil if none
+func (e *effective) matchCmd(command string, tr *Trace) *compiledCmd {
+	for _, allowedCmd := range e.cmds {
+		allowed := allowedCmd.Command
+		// If allowed starts with / we want exact match
+		if strings.HasPrefix(allowed, "/") {
+			tr.add(StepMatch, "`%s` is an absolute path, exact comparison with `%s` : %s", allowed, command, matchResult(allowed == command))
+			if allowed == command {
+				return allowedCmd
+			}
+			continue
+		}
+
+		// if original command starts with slash, we check if it is in the path.
+		if strings.HasPrefix(command, "/") {
+			if allowedPath, err := exec.LookPath(allowed); err == nil {
+				tr.add(StepMatch, "`%s` resolved to `%s` by exec.LookPath, comparison with `%s` : %s", allowed, allowedPath, command, matchResult(allowedPath == command))
+				if allowedPath == command {
+					return allowedCmd
+				}
+				continue
+			}
+			tr.add(StepMatch, "`%s` not found by exec.LookPath", allowed)
+		}
+
+		// both are relative paths or filenames
+		tr.add(StepMatch, "`%s` compared by name with `%s` : %s", allowed, command, matchResult(allowed == command))
+		if allowed == command {
+			return allowedCmd
+		}
+	}
+	return nil
+}
+
+// checkArgs checks allowed and forbidden args and MustMatch regex for the whole command line
+// it returns the reason of the denial if the args are not allowed
+func checkArgs(allowedCmd *compiledCmd, originalArgs string, originalArgsParsed []string, tr *Trace) *Denial {
+	for _, args := range originalArgsParsed {
+		for _, forbiddenRegex := range allowedCmd.forbidden {
+			matched := forbiddenRegex.MatchString(args)
+			tr.add(StepArgs, "argument `%s` forbidden regex `%s` : %s", args, forbiddenRegex, matchResult(matched))
+			if matched {
+				return &Denial{Code: ArgForbidden, Command: allowedCmd.Command, Argument: args, Pattern: forbiddenRegex.String(), Tag: forbiddenRegex.tag}
+			}
+		}
+
+		// if no allowed args, all is allowed
+		if allowedCmd.allowed != nil {
+			found := false
+			for _, allowedRegex := range allowedCmd.allowed {
+				found = allowedRegex.MatchString(args)
+				tr.add(StepArgs, "argument `%s` allowed regex `%s` : %s", args, allowedRegex, matchResult(found))
+				if found {
+					break
+				}
+			}
+			if !found {
+				return &Denial{Code: ArgNotAllowed, Command: allowedCmd.Command, Argument: args}
+			}
+		}
+	}
+	for _, mustMatch := range allowedCmd.mustMatch {
+		matched := mustMatch.MatchString(originalArgs)
+		tr.add(StepMustMatch, "arguments `%s` regex `%s` : %s", originalArgs, mustMatch, matchResult(matched))
+		if !matched {
+			return &Denial{Code: MustMatchFailed, Command: allowedCmd.Command, Argument: originalArgs, Pattern: mustMatch.String(), Tag: mustMatch.tag}
+		}
+	}
+	return nil
+}
+
+// Learn returns the decision to run a denied command as typed in learn mode
+// the command is run without replace nor env expansion, with the global env vars
+// it returns nil if the decision is allowed or if there is nothing to run
+func (d *Decision) Learn() *Decision {
+	if d.Allowed {
+		return nil
+	}
+	parsedOriginalCmd, err := ParseCommandLine(d.Request.Command)
+	if err != nil || len(parsedOriginalCmd) == 0 {
+		return nil
+	}
+	allowedCmd := d.Cmd
+	if allowedCmd == nil {
+		allowedCmd = &Cmd{}
+	}
+	ld := &Decision{Request: d.Request, Allowed: true, Cmd: d.Cmd, Argv: parsedOriginalCmd, Learned: d.Reason, Trace: d.Trace, Config: d.Config}
+	ld.Env, ld.Environ, _ = d.Config.setEnvVars(allowedCmd, d.Request.Env)
+	return ld
+}
+
+// setEnvVars applies the env vars from config and from the allowed cmd on environ
+// it returns the sorted list of vars set by the config, the resulting env and its map
+func (config *Config) setEnvVars(allowedCmd *Cmd, environ []string) ([]string, []string, map[string]string) {
+	setVars := map[string]string{}
+	for envVar, value := range config.SetEnvVars {
+		setVars[envVar] = value
+	}
+	for envVar, value := range allowedCmd.SetEnvVars {
+		setVars[envVar] = value
+	}
+
+	envMap := map[string]string{}
+	var newEnviron []string
+	for _, kv := range environ {
+		key := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			key = kv[:i]
+			envMap[key] = kv[i+1:]
+		}
+		if _, overridden := setVars[key]; !overridden {
+			newEnviron = append(newEnviron, kv)
+		}
+	}
+	set := make([]string, 0, len(setVars))
+	for envVar, value := range setVars {
+		envMap[envVar] = value
+		set = append(set, envVar+"="+value)
+	}
+	sort.Strings(set)
+	return set, append(newEnviron, set...), envMap
+}
+
+// ParseCommandLine function returns a string slice of command line arguments from a full command line string
+// From https://stackoverflow.com/questions/34118732/parse-a-command-line-string-into-flags-and-arguments-in-golang
+// Should better use https://github.com/google/shlex ?
+func ParseCommandLine(command string) ([]string, error) {
+	var args []string
+	state := "start"
+	current := ""
+	quote := "\""
+	escapeNext := true
+	for _, c := range command {
+
+		if state == "quotes" {
+			if string(c) != quote {
+				current += string(c)
+			} else {
+				args = append(args, current)
+				current = ""
+				state = "start"
+			}
+			continue
+		}
+
+		if escapeNext {
+			current += string(c)
+			escapeNext = false
+			continue
+		}
+
+		if c == '\\' {
+			escapeNext = true
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			state = "quotes"
+			quote = string(c)
+			continue
+		}
+
+		if state == "arg" {
+			if c == ' ' || c == '\t' {
+				args = append(args, current)
+				current = ""
+				state = "start"
+			} else {
+				current += string(c)
+			}
+			continue
+		}
+
+		if c != ' ' && c != '\t' {
+			state = "arg"
+			current += string(c)
+		}
+	}
+
+	if state == "quotes" {
+		return []string{}, fmt.Errorf(fmt.Sprintf("unclosed quote in command line: %s", command))
+	}
+
+	if current != "" {
+		args = append(args, current)
+	}
+
+	return args, nil
+}
@@ -0,0 +1,815 @@
+package policy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	p, err := Load("../tests/authcmd_test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name    string
+		req     Request
+		allowed bool
+		argv    []string
+		code    ReasonCode
+		tag     string
+		reason  string
+	}{
+		{
+			name:   "empty command",
+			req:    Request{Command: ""},
+			code:   NoCommand,
+			reason: "direct ssh not allowed, you must specify a command",
+		},
+		{
+			name:    "base command",
+			req:     Request{Command: "ls -a"},
+			allowed: true,
+			argv:    []string{"ls", "-a"},
+		},
+		{
+			name:   "command of a keyTag not given",
+			req:    Request{Command: "id"},
+			code:   CommandNotAllowed,
+			reason: "command `id` not allowed",
+		},
+		{
+			name:    "keyTag merged",
+			req:     Request{Command: "id", Tags: []string{"test1"}},
+			allowed: true,
+			argv:    []string{"id"},
+		},
+		{
+			name:    "unknown keyTag ignored",
+			req:     Request{Command: "ls -a", Tags: []string{"nope"}},
+			allowed: true,
+			argv:    []string{"ls", "-a"},
+		},
+		{
+			name:   "forbidden arg",
+			req:    Request{Command: "/bin/echo $HOME", Tags: []string{"test1"}},
+			code:   ArgForbidden,
+			tag:    "test1",
+			reason: "command `/bin/echo` argument : `$HOME` forbidden : regex `\\$`",
+		},
+		{
+			name:    "replace",
+			req:     Request{Command: "/bin/echo I love pizza", Tags: []string{"test1"}},
+			allowed: true,
+			argv:    []string{"/bin/echo", "We", "love", "pasta"},
+		},
+		{
+			name:    "env expansion from request env",
+			req:     Request{Command: "echo $MY_VAR", Tags: []string{"test5"}, Env: []string{"MY_VAR=from request"}},
+			allowed: true,
+			argv:    []string{"echo", "from", "request"},
+		},
+		{
+			name:   "arg not allowed",
+			req:    Request{Command: "ls -x", Tags: []string{"test1"}},
+			code:   ArgNotAllowed,
+			reason: "command `ls` arguments : `-x` not allowed",
+		},
+		{
+			name:   "unclosed quote",
+			req:    Request{Command: "ls 'a"},
+			code:   ParseError,
+			reason: "unclosed quote in command line: ls 'a",
+		},
+		{
+			name:   "must match",
+			req:    Request{Command: "cat /etc/passwd", Tags: []string{"test9"}},
+			code:   MustMatchFailed,
+			tag:    "test9",
+			reason: "command `cat` arguments : ` /etc/passwd` not matching regex `.*LICENSE$`",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := p.Evaluate(tc.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != tc.allowed {
+				t.Fatalf("Want allowed '%t', got '%t' (%v)", tc.allowed, d.Allowed, d.Reason)
+			}
+			if tc.allowed && strings.Join(d.Argv, "\x00") != strings.Join(tc.argv, "\x00") {
+				t.Errorf("Want argv %q, got %q", tc.argv, d.Argv)
+			}
+			if tc.allowed {
+				return
+			}
+			if d.Reason.Code != tc.code || d.Reason.Tag != tc.tag {
+				t.Errorf("Want code '%s' tag '%s', got '%s' '%s'", tc.code, tc.tag, d.Reason.Code, d.Reason.Tag)
+			}
+			if d.Reason.Error() != tc.reason {
+				t.Errorf("Want reason '%s', got '%s'", tc.reason, d.Reason.Error())
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	if _, err := Parse([]byte("allowedCmd:\n  - command: ls\n    args:\n      allowed: [\"(\"]\n")); err == nil || !strings.HasPrefix(err.Error(), "invalid config : command `ls` allowed regex `(`") {
+		t.Errorf("Want invalid regex error, got '%v'", err)
+	}
+	if _, err := Parse([]byte("allowedCmd:\n  -\n  - command: ls\nkeyTags:\n  ops:\n    allowedCmd: [~]\n")); err == nil ||
+		err.Error() != "invalid config : `allowedCmd[0]` is empty, keyTag `ops` `allowedCmd[0]` is empty" {
+		t.Errorf("Want null allowed cmds rejected, got '%v'", err)
+	}
+	if _, err := New(&Config{AllowedCmd: []*Cmd{nil}}); err == nil {
+		t.Errorf("Want a null allowed cmd rejected by New")
+	}
+	p, err := Parse([]byte("allowedCmd:\n  - command: ls\nkeyTags:\n  noshell:\n    useShell: /does/not/exist\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := p.Evaluate(Request{Command: "ls", Tags: []string{"noshell"}}); d.Allowed || d.Reason.Code != ShellNotFound || d.Reason.Shell != "/does/not/exist" {
+		t.Errorf("Want shell not found, got '%v'", d.Reason)
+	}
+	effective, _ := p.Effective(nil)
+	effective.AllowedCmd = nil
+	if d, _ := p.Evaluate(Request{Command: "ls"}); !d.Allowed {
+		t.Errorf("Want policy unchanged by a change of its effective config copy")
+	}
+}
+
+func TestConcurrentEvaluate(t *testing.T) {
+	p, err := Load("../tests/authcmd_test.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tag := fmt.Sprintf("test%d", i%12+1)
+			d, err := p.Evaluate(Request{Command: "ls -a", Tags: []string{tag, "test1"}, Trace: true})
+			if err != nil {
+				errs <- err.Error()
+				return
+			}
+			if len(d.Trace.Steps) == 0 {
+				errs <- fmt.Sprintf("%s : empty trace", tag)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for msg := range errs {
+		t.Error(msg)
+	}
+	// merging keyTags must not change the base config
+	if d, _ := p.Evaluate(Request{Command: "id"}); d.Allowed {
+		t.Errorf("Want base config unchanged by the keyTags merges")
+	}
+}
+
+func TestExecutorStdin(t *testing.T) {
+	p, err := Parse([]byte("allowedCmd:\n  - command: cat\n    stdin: true\n  - command: head\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for command, want := range map[string]string{"cat": "input", "head": ""} {
+		d, _ := p.Evaluate(Request{Command: command})
+		var stdout strings.Builder
+		if _, err := (&Executor{Stdin: strings.NewReader("input"), Stdout: &stdout}).Run(d); err != nil {
+			t.Fatal(err)
+		}
+		if stdout.String() != want {
+			t.Errorf("Want `%s` output '%s', got '%s'", command, want, stdout.String())
+		}
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	tt := []struct {
+		name   string
+		format string
+		data   string
+		err    string
+	}{
+		{
+			name:   "json",
+			format: FormatJSON,
+			data:   `{"allowedCmd": [{"command": "ls", "args": {"allowed": ["^-l$"]}}], "exitCodes": {"DENIED": 3}}`,
+		},
+		{
+			name:   "toml",
+			format: FormatTOML,
+			data:   "exitCodes.DENIED = 3\n[[allowedCmd]]\ncommand = \"ls\"\nargs.allowed = ['^-l$']\n",
+		},
+		{
+			name:   "json syntax error",
+			format: FormatJSON,
+			data:   "{\n  \"allowedCmd\": [\n    {\"command\" \"ls\"}\n  ]\n}",
+			err:    "json: line 3 column 16: invalid character '\"' after object key",
+		},
+		{
+			name:   "toml syntax error",
+			format: FormatTOML,
+			data:   "[[allowedCmd]]\ncommand = ls\n",
+			err:    "toml: line 2 column 11: ",
+		},
+		{
+			name:   "toml duplicate key",
+			format: FormatTOML,
+			data:   "[[allowedCmd]]\ncommand = \"ls\"\ncommand = \"id\"\n",
+			err:    "toml: key command is already defined",
+		},
+		{
+			name:   "unknown format",
+			format: "ini",
+			err:    "unknown config format `ini`, must be yaml, json or toml",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParseFormat([]byte(tc.data), tc.format)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("Want error '%s', got '%v'", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d, _ := p.Evaluate(Request{Command: "ls -l"}); !d.Allowed {
+				t.Errorf("Want allowed, got '%v'", d.Reason)
+			}
+			if d, _ := p.Evaluate(Request{Command: "ls -a"}); d.Allowed || d.ExitCode() != 3 {
+				t.Errorf("Want denied with exit code 3, got '%t' '%d'", d.Allowed, d.ExitCode())
+			}
+		})
+	}
+}
+
+func TestValidateFormat(t *testing.T) {
+	// json and toml issues have no position, the keys are sorted
+	issues := ValidateFormat([]byte("{\n  \"showDenied\": 1,\n  \"allowedCmd\": [{\"command\": \"ls\", \"mustmatch\": []}]\n}"), FormatJSON)
+	if len(issues) != 2 || issues[0].String() != "unknown key `allowedCmd[0].mustmatch`, did you mean `mustMatch` ?" ||
+		issues[1].String() != "`showDenied` must be a boolean" {
+		t.Errorf("Want the json issues, got %v", issues)
+	}
+	issues = ValidateFormat([]byte("showDenied = 1\n\n[[allowedCmd]]\ncommand = \"ls\"\nmustmatch = []\n"), FormatTOML)
+	if len(issues) != 2 || issues[0].String() != "unknown key `allowedCmd[0].mustmatch`, did you mean `mustMatch` ?" ||
+		issues[1].String() != "`showDenied` must be a boolean" {
+		t.Errorf("Want the toml issues, got %v", issues)
+	}
+}
+
+func TestLoadLayers(t *testing.T) {
+	p, err := LoadLayers(Layer{File: "../tests/layers/system/authcmd.yml"}, Layer{File: "../tests/layers/user/authcmd.yml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, source := range p.Sources() {
+		files = append(files, source.File)
+	}
+	want := "../tests/layers/system/authcmd.yml,../tests/layers/user/authcmd.yml,../tests/layers/user/common/echo.yml," +
+		"../tests/layers/user/authcmd.d/10-ops.toml,../tests/layers/user/authcmd.d/20-dev.json"
+	if strings.Join(files, ",") != want {
+		t.Errorf("Want the files '%s', got '%s'", want, strings.Join(files, ","))
+	}
+
+	tt := []struct {
+		command string
+		tags    []string
+		allowed bool
+	}{
+		{command: "id", allowed: true},
+		{command: "ls -l", allowed: true},
+		{command: "/bin/echo hi", allowed: true},
+		{command: "ls -a"},
+		{command: "ls -a", tags: []string{"ops"}, allowed: true},
+		{command: "ls -l", tags: []string{"ops"}, allowed: true},
+		{command: "uptime", tags: []string{"ops"}, allowed: true},
+		{command: "git status", tags: []string{"dev"}, allowed: true},
+		{command: "git status", tags: []string{"ops"}},
+	}
+	for _, tc := range tt {
+		d, err := p.Evaluate(Request{Command: tc.command, Tags: tc.tags, Trace: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Allowed != tc.allowed {
+			t.Errorf("Want '%s' with tags %v allowed '%t', got '%t'", tc.command, tc.tags, tc.allowed, d.Allowed)
+		}
+	}
+	d, _ := p.Evaluate(Request{Command: "uptime", Tags: []string{"ops"}, Trace: true})
+	if trace := d.Trace.Text(); !strings.Contains(trace, "keyTag `ops` merged from `../tests/layers/system/authcmd.yml`, "+
+		"`../tests/layers/user/authcmd.yml`, `../tests/layers/user/authcmd.d/10-ops.toml`") {
+		t.Errorf("Want the files of the keyTag traced, got '%s'", trace)
+	}
+	if config, _ := p.Effective([]string{"ops"}); config.ShowDenied == nil || !*config.ShowDenied {
+		t.Errorf("Want showDenied overridden by the keyTag of the user file")
+	}
+
+	errs := map[string]string{
+		"../tests/layers/cycle/a.yml":         "include cycle on file `../tests/layers/cycle/a.yml`",
+		"../tests/layers/missing/authcmd.yml": "included file `common.yml` not found",
+	}
+	for file, want := range errs {
+		if _, err := Load(file); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Want error '%s' loading '%s', got '%v'", want, file, err)
+		}
+	}
+}
+
+func TestMergeStrategies(t *testing.T) {
+	p, err := Parse([]byte(`
+allowedCmd:
+  - command: ls
+    args:
+      allowed: ["^-l$"]
+      forbidden: ["^/etc"]
+  - command: id
+  - command: /bin/echo
+    replace: {"pizza": "pasta", "I": "We"}
+keyTags:
+  append:
+    allowedCmd:
+      - command: ls
+        args:
+          allowed: ["^-a$"]
+  replace:
+    merge: replace
+    allowedCmd:
+      - command: ls
+        args:
+          allowed: ["^-a$"]
+  remove:
+    allowedCmd:
+      - command: ls
+        merge: remove
+        args:
+          allowed: ["^-l$"]
+          forbidden: ["^/etc"]
+      - command: /bin/echo
+        merge: remove
+        replace: {"I": ""}
+  restricted:
+    removeCmd: [id, ls]
+    allowedCmd:
+      - command: ls
+        args:
+          allowed: ["^-1$"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		command string
+		tag     string
+		allowed bool
+		argv    string
+	}{
+		{command: "ls -l", tag: "append", allowed: true},
+		{command: "ls -a", tag: "append", allowed: true},
+		{command: "ls /etc", tag: "append"},
+		{command: "ls -l", tag: "replace"},
+		{command: "ls -a", tag: "replace", allowed: true},
+		// the last allowed regex removed, no argument is allowed
+		{command: "ls -l", tag: "remove"},
+		{command: "ls /etc", tag: "remove"},
+		{command: "ls", tag: "remove", allowed: true},
+		{command: "/bin/echo I love pizza", tag: "remove", allowed: true, argv: "/bin/echo I love pasta"},
+		{command: "id", tag: "restricted"},
+		{command: "ls -l", tag: "restricted"},
+		{command: "ls -1", tag: "restricted", allowed: true},
+		{command: "id", tag: "remove", allowed: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.tag+" "+tc.command, func(t *testing.T) {
+			d, err := p.Evaluate(Request{Command: tc.command, Tags: []string{tc.tag}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allowed != tc.allowed {
+				t.Fatalf("Want allowed '%t', got '%t' (%v)", tc.allowed, d.Allowed, d.Reason)
+			}
+			if tc.argv != "" && strings.Join(d.Argv, " ") != tc.argv {
+				t.Errorf("Want argv '%s', got %q", tc.argv, d.Argv)
+			}
+		})
+	}
+	config, _ := p.Effective([]string{"restricted"})
+	if config.RemoveCmd != nil || config.AllowedCmd[0].Command != "/bin/echo" || config.AllowedCmd[1].Merge != "" {
+		t.Errorf("Want the merge directives applied, got %+v", config)
+	}
+}
+
+func TestExtends(t *testing.T) {
+	p, err := Parse([]byte(`
+allowedCmd:
+  - command: ls
+profiles:
+  readonly:
+    showDenied: true
+    allowedCmd:
+      - command: cat
+        args:
+          forbidden: ["^/etc"]
+  audit:
+    extends: [readonly]
+    setEnvVars:
+      AUDIT: "yes"
+keyTags:
+  ops:
+    allowedCmd:
+      - command: uptime
+  auditor:
+    extends: [audit, ops]
+    showDenied: false
+    removeCmd: [ls]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := p.Effective([]string{"auditor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for _, allowedCmd := range config.AllowedCmd {
+		commands = append(commands, allowedCmd.Command)
+	}
+	if strings.Join(commands, ",") != "cat,uptime" || config.SetEnvVars["AUDIT"] != "yes" || config.ShowDenied == nil || *config.ShowDenied {
+		t.Errorf("Want the profiles and keyTag extended, overridden by the keyTag, got %v %v %v", commands, config.SetEnvVars, config.ShowDenied)
+	}
+	if d, _ := p.Evaluate(Request{Command: "cat /etc/passwd", Tags: []string{"auditor"}}); d.Allowed || d.Reason.Tag != "auditor" {
+		t.Errorf("Want the regex of the profile denying for the keyTag, got '%v'", d.Reason)
+	}
+
+	errs := map[string]string{
+		"cycle":   "profiles:\n  a:\n    extends: [b]\n  b:\n    extends: [a]\nkeyTags:\n  t:\n    extends: [a]\n",
+		"unknown": "keyTags:\n  t:\n    extends: [nope]\n",
+		"both":    "profiles:\n  t2:\n    showDenied: true\nkeyTags:\n  t:\n    extends: [t2]\n  t2:\n    showDenied: false\n",
+	}
+	want := map[string]string{
+		"cycle":   "extends cycle : `a` -> `b` -> `a`",
+		"unknown": "keyTag `t` extends unknown profile or keyTag `nope`",
+		"both":    "keyTag `t` extends `t2` which is both a profile and a keyTag",
+	}
+	for name, data := range errs {
+		if _, err := Parse([]byte(data)); err == nil || !strings.Contains(err.Error(), want[name]) {
+			t.Errorf("Want error '%s', got '%v'", want[name], err)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	p, err := Parse([]byte(`
+keyTags:
+  deploy:
+    params:
+      project:
+        pattern: "[a-z.]+"
+      suffix:
+        values: ["$1", "-old"]
+    setEnvVars:
+      PROJECT: ${project}
+    allowedCmd:
+      - command: deploy
+        args:
+          allowed: ["^/srv/${project}(/|$)"]
+          forbidden: ["${project}/secret"]
+        replace: {"/srv/${project}$": "/srv/${project}${suffix}"}
+      - command: status
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt := []struct {
+		name    string
+		command string
+		tags    []string
+		argv    string
+		reason  string
+	}{
+		{name: "allowed", command: "deploy /srv/shop/app", tags: []string{"deploy", "project=shop", "suffix=-old"}, argv: "deploy /srv/shop/app"},
+		{name: "quoted in regex", command: "deploy /srv/aXb/app", tags: []string{"deploy", "project=a.b", "suffix=-old"}, reason: "command `deploy` arguments : `/srv/aXb/app` not allowed"},
+		{name: "quoted in replacement", command: "deploy /srv/shop", tags: []string{"deploy", "project=shop", "suffix=$1"}, argv: "deploy /srv/shop$1"},
+		{name: "forbidden", command: "deploy /srv/shop/secret", tags: []string{"deploy", "project=shop", "suffix=-old"}, reason: "command `deploy` argument : `/srv/shop/secret` forbidden : regex `shop/secret`"},
+		{name: "missing", command: "deploy /srv/shop/app", tags: []string{"deploy", "project=shop"}, reason: "command `deploy` needs param `suffix`"},
+		{name: "missing unused", command: "status", tags: []string{"deploy", "suffix=-old"}, reason: "command `status` needs param `project`"},
+		{name: "not allowed", command: "status", tags: []string{"deploy", "project=Shop"}, reason: "param `project` value `Shop` not allowed"},
+		{name: "not declared", command: "status", tags: []string{"deploy", "other=1"}, reason: "param `other` not declared"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			d, err := p.Evaluate(Request{Command: tc.command, Tags: tc.tags})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.reason != "" {
+				if d.Allowed || d.Reason.Error() != tc.reason {
+					t.Errorf("Want denied '%s', got '%t' '%v'", tc.reason, d.Allowed, d.Reason)
+				}
+				return
+			}
+			if !d.Allowed || strings.Join(d.Argv, " ") != tc.argv {
+				t.Errorf("Want allowed '%s', got '%t' %q (%v)", tc.argv, d.Allowed, d.Argv, d.Reason)
+			}
+			if strings.Join(d.Env, ",") != "PROJECT=shop" {
+				t.Errorf("Want the env var interpolated, got %q", d.Env)
+			}
+		})
+	}
+	if d, _ := p.Evaluate(Request{Command: "deploy /srv/shop/secret", Tags: []string{"deploy", "project=shop", "suffix=-old"}}); d.Reason == nil || d.Reason.Tag != "deploy" {
+		t.Errorf("Want the keyTag of the interpolated regex, got '%v'", d.Reason)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	p, err := Parse([]byte(`
+variables:
+  home: ${HOME}/work
+profiles:
+  own:
+    allowedCmd:
+      - command: cat
+        args:
+          allowed: ["^${home}/${TAG}/", "^/var/log/${USER}\\.log$"]
+keyTags:
+  ops:
+    extends: [own]
+    setEnvVars:
+      FROM: ${SSH_CLIENT_IP}
+    allowedCmd:
+      - command: tag-${TAG}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := Request{Tags: []string{"ops"}, Env: []string{"HOME=/home/a.b"}, Client: Client{User: "a.b", IP: "10.0.0.1"}}
+	tt := []struct {
+		name    string
+		command string
+		req     Request
+		argv    string
+		reason  string
+	}{
+		{name: "config variable", command: "cat /home/a.b/work/ops/file", req: req, argv: "cat /home/a.b/work/ops/file"},
+		{name: "quoted", command: "cat /var/log/aXb.log", req: req, reason: "command `cat` arguments : `/var/log/aXb.log` not allowed"},
+		{name: "builtin", command: "cat /var/log/a.b.log", req: req, argv: "cat /var/log/a.b.log"},
+		{name: "tag in command", command: "tag-ops", req: req, argv: "tag-ops"},
+		{name: "missing config variable", command: "cat /var/log/a.b.log", req: Request{Tags: req.Tags, Client: req.Client}, reason: "command `cat` needs variable `home`"},
+		{name: "missing builtin", command: "tag-ops", req: Request{Tags: req.Tags, Env: req.Env, Client: Client{User: "a.b"}}, reason: "command `tag-ops` needs variable `SSH_CLIENT_IP`"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.req.Command = tc.command
+			d, err := p.Evaluate(tc.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.reason != "" {
+				if d.Allowed || d.Reason.Error() != tc.reason {
+					t.Errorf("Want denied '%s', got '%t' '%v'", tc.reason, d.Allowed, d.Reason)
+				}
+				return
+			}
+			if !d.Allowed || strings.Join(d.Argv, " ") != tc.argv {
+				t.Errorf("Want allowed '%s', got '%t' %q (%v)", tc.argv, d.Allowed, d.Argv, d.Reason)
+			}
+			if strings.Join(d.Env, ",") != "FROM=10.0.0.1" {
+				t.Errorf("Want the env var interpolated, got %q", d.Env)
+			}
+		})
+	}
+	// without keyTag, ${TAG} has no value
+	if d, _ := p.Evaluate(Request{Command: "cat /home/a.b/work//file", Env: req.Env}); d.Allowed {
+		t.Errorf("Want the base config without cat, got allowed")
+	}
+}
+
+func TestInterpolated(t *testing.T) {
+	p, err := Parse([]byte(`
+keyTags:
+  ops:
+    params:
+      project:
+        values: [shop]
+    allowedCmd:
+      - command: cat
+        args:
+          allowed: ["^/srv/${project}/", "^/home/${USER}/"]
+      - command: ping
+        args:
+          allowed: ["^${SSH_CLIENT_IP}$"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := p.Interpolated(Request{Tags: []string{"ops", "project=shop"}, Client: Client{User: "alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.AllowedCmd) != 1 || strings.Join(config.AllowedCmd[0].Args.Allowed, " ") != "^/srv/shop/ ^/home/alice/" {
+		t.Errorf("Want cat interpolated and ping without client ip left out, got %v", config.AllowedCmd)
+	}
+	if _, err := p.Interpolated(Request{Tags: []string{"ops", "project=blog"}}); err == nil || err.Error() != "param `project` value `blog` not allowed" {
+		t.Errorf("Want the param denial, got '%v'", err)
+	}
+}
+
+func TestUndeclaredVariables(t *testing.T) {
+	config := `
+keyTags:
+  ops:
+    allowedCmd:
+      - command: cat
+        args:
+          forbidden: ["^/srv/${projet}/secret"]
+`
+	_, err := Parse([]byte(config))
+	if err == nil || err.Error() != "invalid config : keyTag `ops` allowedCmd `cat` uses undeclared variable `${projet}`" {
+		t.Errorf("Want the undeclared variable rejected, got '%v'", err)
+	}
+	issues := Validate([]byte(config))
+	if len(issues) != 1 || issues[0].String() != "line 7 column 23 : undeclared variable `${projet}` in `keyTags.ops.allowedCmd[0].args.forbidden[0]`" {
+		t.Errorf("Want the undeclared variable issue, got %v", issues)
+	}
+	if issues := ValidateLayer([]byte(config), FormatYAML, []string{"projet"}); len(issues) != 0 {
+		t.Errorf("Want the variable declared by another file, got %v", issues)
+	}
+
+	// a param declared in another keyTag has no value, the group of a replace rule is kept
+	p, err := Parse([]byte(`
+keyTags:
+  deploy:
+    params:
+      project:
+        pattern: "[a-z]+"
+  ops:
+    allowedCmd:
+      - command: cat
+        args:
+          forbidden: ["^/srv/${project}/secret"]
+      - command: ls
+        replace: {"(?P<dir>/srv)/old": "${dir}/new"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := p.Evaluate(Request{Command: "cat /srv/shop/secret", Tags: []string{"ops"}}); d.Allowed || d.Reason.Error() != "command `cat` needs variable `project`" {
+		t.Errorf("Want the cmd denied without the param, got '%t' '%v'", d.Allowed, d.Reason)
+	}
+	if d, _ := p.Evaluate(Request{Command: "ls /srv/old", Tags: []string{"ops"}}); !d.Allowed || strings.Join(d.Argv, " ") != "ls /srv/new" {
+		t.Errorf("Want the capture group replaced, got '%t' %q (%v)", d.Allowed, d.Argv, d.Reason)
+	}
+}
+
+func TestAuthKeys(t *testing.T) {
+	const alice = "AAAAC3NzaC1lZDI1NTE5AAAAIMsZ8LTJUT2iZwXlkAxqDiIzwqP2h0BL6mfrknS9C3lD"
+	const bob = "AAAAC3NzaC1lZDI1NTE5AAAAIIcRJ68jfpp/QwUFn8i0cIYk3slfS/YJpgDMYiBfy+lH"
+	keys, err := ParseUserAuth([]byte("password\npublickey ssh-ed25519 " + alice + "\npublickey ssh-ed25519 " + bob + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Type != "ssh-ed25519" || keys[0].Fingerprint != "SHA256:/Q0g+h1iSL8rgue9lEAm0ZFPKPHGcQrKSRS/A2GlBqQ" ||
+		keys[1].Fingerprint != "SHA256:TSFUqbjPkPG+EFgnDrOxNVBBxSmQ8kReIFleByOPHco" {
+		t.Fatalf("Want the keys with the fingerprints of ssh-keygen -l, got %v", keys)
+	}
+	if _, err := ParseUserAuth([]byte("publickey ssh-rsa " + alice)); err == nil {
+		t.Errorf("Want an error for a key not of its type")
+	}
+
+	p, err := Parse([]byte(`
+keys:
+  - key: ssh-ed25519 ` + alice + ` alice
+    tags: [ops, dev]
+  - key: SHA256:TSFUqbjPkPG+EFgnDrOxNVBBxSmQ8kReIFleByOPHco
+    tags: [dev, audit]
+keyTags:
+  ops:
+    allowedCmd:
+      - command: ls
+  dev:
+    allowedCmd:
+      - command: git
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := strings.Join(p.AuthTags(keys), ","); tags != "ops,dev,audit" {
+		t.Errorf("Want the keyTags of both keys in order, got '%s'", tags)
+	}
+	if tags := p.AuthTags([]AuthKey{{Type: "ssh-ed25519", Fingerprint: "SHA256:unknown"}}); tags != nil {
+		t.Errorf("Want no keyTags for an unknown key, got %q", tags)
+	}
+	d, err := p.Evaluate(Request{Command: "ls", Tags: p.AuthTags(keys[:1]), Client: Client{Keys: keys[:1]}, Trace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Allowed || !strings.Contains(d.Trace.Text(), "key `SHA256:/Q0g+h1iSL8rgue9lEAm0ZFPKPHGcQrKSRS/A2GlBqQ` mapped to keyTags `ops`, `dev`") {
+		t.Errorf("Want allowed with the key traced, got '%t' '%s'", d.Allowed, d.Trace.Text())
+	}
+	if _, err := Parse([]byte("keys:\n  - key: SHA256:short\n    tags: [ops]\n")); err == nil || !strings.Contains(err.Error(), "invalid key in `keys[0]` : fingerprint `SHA256:short`") {
+		t.Errorf("Want an invalid key refused, got '%v'", err)
+	}
+}
+
+func TestCertificates(t *testing.T) {
+	data, err := ioutil.ReadFile("../tests/ssh_user_auth_cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseUserAuth(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as printed by ssh-keygen -L
+	cert := keys[0].Cert
+	if len(keys) != 1 || cert == nil || keys[0].Fingerprint != "SHA256:IE/5AVS0n7gaMm46t72ccFkiiwmLmlmWEKB+NL03I3I" ||
+		cert.KeyID != "alice@example.com" || cert.Serial != 42 || strings.Join(cert.Principals, ",") != "alice,role-ops,role-audit" ||
+		cert.CA != "SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM" || cert.CriticalOptions["source-address"] != "10.0.0.0/8" ||
+		cert.Extensions["authcmd-roles@example.com"] != "test21,deploy" || cert.Extensions["permit-pty"] != "" || cert.ValidBefore != math.MaxUint64 {
+		t.Fatalf("Want the certificate of ssh-keygen -L, got %+v %+v", keys, cert)
+	}
+	if err := (&Certificate{KeyID: "old", ValidAfter: 100, ValidBefore: 200}).Valid(time.Unix(200, 0)); err == nil || err.Error() != "certificate `old` expired at 1970-01-01T00:03:20Z" {
+		t.Errorf("Want the certificate expired, got '%v'", err)
+	}
+	if err := (&Certificate{KeyID: "new", ValidAfter: 100, ValidBefore: 200}).Valid(time.Unix(99, 0)); err == nil {
+		t.Errorf("Want the certificate not yet valid")
+	}
+
+	p, err := Parse([]byte(`
+keys:
+  - key: SHA256:IE/5AVS0n7gaMm46t72ccFkiiwmLmlmWEKB+NL03I3I
+    tags: [laptop]
+certificates:
+  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM
+    principal: role-(.+)
+    tags: [$1]
+  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM
+    keyId: ".*@example\\.com"
+    tags: [staff]
+  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM
+    principal: role
+    tags: [unanchored]
+  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM
+    option: authcmd-roles@example.com
+  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM
+    option: force-command
+    tags: [forced]
+  - ca: SHA256:TSFUqbjPkPG+EFgnDrOxNVBBxSmQ8kReIFleByOPHco
+    tags: [other-ca]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := strings.Join(p.AuthTags(keys), ","); tags != "laptop,ops,audit,staff,test21,deploy" {
+		t.Errorf("Want the keyTags of the key and certificate rules, got '%s'", tags)
+	}
+	data, err = ioutil.ReadFile("../tests/ssh_user_auth_expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys, err = ParseUserAuth(data); err != nil {
+		t.Fatal(err)
+	}
+	if tags := p.AuthTags(keys); tags != nil {
+		t.Errorf("Want no keyTags for an expired certificate, got %q", tags)
+	}
+	d, err := p.Evaluate(Request{Command: "ls", Client: Client{Keys: keys}, Trace: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(d.Trace.Text(), "certificate `old@example.com` of key `SHA256:IE/5AVS0n7gaMm46t72ccFkiiwmLmlmWEKB+NL03I3I` ignored : certificate `old@example.com` expired at 2020-01-02") {
+		t.Errorf("Want the expired certificate traced, got '%s'", d.Trace.Text())
+	}
+	if _, err := Parse([]byte("certificates:\n  - ca: SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM\n    principal: (\n")); err == nil || !strings.Contains(err.Error(), "invalid rule in `certificates[0]` : regex `(`") {
+		t.Errorf("Want an invalid rule refused, got '%v'", err)
+	}
+	if _, err := Parse([]byte("certificates:\n  - principal: alice\n    tags: [ops]\n")); err == nil || !strings.Contains(err.Error(), "invalid rule in `certificates[0]` : ca is required") {
+		t.Errorf("Want a rule without ca refused, got '%v'", err)
+	}
+
+	// the values of the certificate can not become params
+	forged := &Certificate{
+		CA:         "SHA256:kDlz7w6Iy1plVh2Z2c291VKe7cAk7uPd4JNtCvLd3kM",
+		Principals: []string{"role-project=prod", "role-dev"},
+		Extensions: map[string]string{"authcmd-roles@example.com": "test21,project=prod, deploy"},
+	}
+	if tags := strings.Join(p.config.Certificates[0].tags(forged), ","); tags != "dev" {
+		t.Errorf("Want the principal setting a param ignored, got '%s'", tags)
+	}
+	if tags := strings.Join(p.config.Certificates[3].tags(forged), ","); tags != "test21,deploy" {
+		t.Errorf("Want the extension value setting a param ignored, got '%s'", tags)
+	}
+}
@@ -0,0 +1,115 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A fragment is a keyTag or a profile, a partial config merged into the base config
+type fragment struct {
+	kind   string
+	name   string
+	config *Config
+}
+
+// String returns the kind and quoted name of the fragment
+func (f fragment) String() string {
+	return fmt.Sprintf("%s `%s`", f.kind, f.name)
+}
+
+// mergeFragment merges a keyTag or profile into the config of a keyTag or profile
+// each cmd keeps its merge strategy and the removeCmd and extends of both are kept,
+// so the result is merged into the base config as both would be, in order
+// fragment is not modified
+func (config *Config) mergeFragment(fragment *Config) {
+	fragment = fragment.Clone()
+	fragment.cmdStrategies()
+	config.cmdStrategies()
+	config.mergeConfig(fragment)
+	for _, command := range fragment.RemoveCmd {
+		if !contains(config.RemoveCmd, command) {
+			config.RemoveCmd = append(config.RemoveCmd, command)
+		}
+	}
+	for _, name := range fragment.Extends {
+		if !contains(config.Extends, name) {
+			config.Extends = append(config.Extends, name)
+		}
+	}
+}
+
+// lookup returns the profile, or else the keyTag, extended by name
+func (config *Config) lookup(from fragment, name string) (fragment, error) {
+	profile, isProfile := config.Profiles[name]
+	tagConfig, isTag := config.KeyTags[name]
+	switch {
+	case isProfile && isTag:
+		return fragment{}, fmt.Errorf("%s extends `%s` which is both a profile and a keyTag", from, name)
+	case isProfile:
+		return fragment{kind: "profile", name: name, config: profile}, nil
+	case isTag:
+		return fragment{kind: "keyTag", name: name, config: tagConfig}, nil
+	}
+	return fragment{}, fmt.Errorf("%s extends unknown profile or keyTag `%s`", from, name)
+}
+
+// resolveExtends returns the keyTags of the config merged with the profiles and keyTags they extend, transitively
+// the extended fragments are merged in the order of extends, then the keyTag itself, which overrides them
+// an error is returned on an unknown name or a cycle
+func (config *Config) resolveExtends() (map[string]*Config, error) {
+	resolved := map[string]*Config{}
+	var resolve func(f fragment, chain []fragment) (*Config, error)
+	resolve = func(f fragment, chain []fragment) (*Config, error) {
+		for i, previous := range chain {
+			if previous.kind == f.kind && previous.name == f.name {
+				names := make([]string, 0, len(chain)-i+1)
+				for _, c := range append(chain[i:], f) {
+					names = append(names, "`"+c.name+"`")
+				}
+				return nil, fmt.Errorf("extends cycle : %s", strings.Join(names, " -> "))
+			}
+		}
+		key := f.kind + "\x00" + f.name
+		if r, ok := resolved[key]; ok {
+			return r, nil
+		}
+		if f.config == nil || len(f.config.Extends) == 0 {
+			resolved[key] = f.config
+			return f.config, nil
+		}
+		r := &Config{}
+		for _, name := range f.config.Extends {
+			extended, err := config.lookup(f, name)
+			if err != nil {
+				return nil, err
+			}
+			extendedConfig, err := resolve(extended, append(chain, f))
+			if err != nil {
+				return nil, err
+			}
+			if extendedConfig != nil {
+				r.mergeFragment(extendedConfig)
+			}
+		}
+		r.mergeFragment(f.config)
+		r.Extends = cloneSlice(f.config.Extends)
+		resolved[key] = r
+		return r, nil
+	}
+
+	tags := make(map[string]*Config, len(config.KeyTags))
+	for _, tag := range config.Tags() {
+		r, err := resolve(fragment{kind: "keyTag", name: tag, config: config.KeyTags[tag]}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			r = r.Clone()
+		}
+		tags[tag] = r
+	}
+	if config.KeyTags == nil {
+		return nil, nil
+	}
+	return tags, nil
+}
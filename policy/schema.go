@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"reflect"
+)
+
+// Schema returns the JSON Schema of the config file generated from the Config type
+// every struct type is a definition referenced by its name
+func Schema() map[string]interface{} {
+	defs := map[string]interface{}{}
+	root := typeSchema(configType, defs)
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "https://github.com/dranih/authcmd/authcmd.schema.json",
+		"title":   "authcmd config file",
+		"$ref":    root["$ref"],
+		"$defs":   defs,
+	}
+}
+
+// typeSchema returns the schema of the type t, adding the struct types definitions in defs
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+		if _, exists := defs[t.Name()]; exists {
+			return ref
+		}
+		properties := map[string]interface{}{}
+		def := map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": false,
+			"properties":           properties,
+		}
+		// registered before the fields for recursive types
+		defs[t.Name()] = def
+		for name, field := range yamlFields(t) {
+			properties[name] = typeSchema(field.Type, defs)
+		}
+		switch t {
+		case cmdType:
+			def["required"] = []string{"command"}
+		case certType:
+			def["required"] = []string{"ca"}
+		}
+		return ref
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": typeSchema(t.Elem(), defs)}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": typeSchema(t.Elem(), defs)}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int:
+		return map[string]interface{}{"type": "integer"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Steps of a trace
+const (
+	StepConfig    = "config"
+	StepTags      = "tags"
+	StepParams    = "params"
+	StepMatch     = "match"
+	StepArgs      = "args"
+	StepMustMatch = "mustMatch"
+	StepReplace   = "replace"
+	StepEnv       = "env"
+	StepShell     = "shell"
+	StepDecision  = "decision"
+)
+
+// A Trace records every step of the evaluation of a command line
+// to explain why it was allowed or denied
+// A nil *Trace records nothing
+type Trace struct {
+	Steps []TraceStep `json:"steps"`
+}
+
+// A TraceStep is one step of a trace
+type TraceStep struct {
+	Step    string `json:"step"`
+	Message string `json:"message"`
+}
+
+// add appends a step to the trace, message is formatted with args
+func (t *Trace) add(step string, msg string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, TraceStep{Step: step, Message: fmt.Sprintf(msg, args...)})
+}
+
+// Text returns the trace as human readable lines
+func (t *Trace) Text() string {
+	var sb strings.Builder
+	for _, step := range t.Steps {
+		fmt.Fprintf(&sb, "[%s] %s\n", step.Step, step.Message)
+	}
+	return sb.String()
+}
+
+// JSON returns the trace as an indented json document
+func (t *Trace) JSON() string {
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(t)
+	return sb.String()
+}
+
+// matchResult returns a readable result of a regex or string comparison for a trace
+func matchResult(matched bool) string {
+	if matched {
+		return "match"
+	}
+	return "no match"
+}
@@ -0,0 +1,395 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/yamlnode"
+	"gopkg.in/yaml.v3"
+)
+
+// An Issue is a problem found in a config file at a given position
+// Line is 0 if the file can not be decoded and for the json and toml files, decoded without position
+type Issue struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+// String returns the issue with its position, if known
+func (i Issue) String() string {
+	if i.Line == 0 {
+		return i.Msg
+	}
+	return fmt.Sprintf("line %d column %d : %s", i.Line, i.Column, i.Msg)
+}
+
+// A configValidator walks the yaml nodes of a config file along the Config type
+// and collects the issues
+type configValidator struct {
+	issues []Issue
+	// declared are the names usable as ${name}
+	declared map[string]bool
+}
+
+// Types of the config validated with specific rules
+var (
+	configType = reflect.TypeOf(Config{})
+	cmdType    = reflect.TypeOf(Cmd{})
+	argsType   = reflect.TypeOf(Args{})
+	paramType  = reflect.TypeOf(Param{})
+	keyType    = reflect.TypeOf(Key{})
+	certType   = reflect.TypeOf(CertRule{})
+)
+
+// Validate checks the yaml data of a config file :
+// unknown keys, wrong types, empty or duplicate commands, invalid regex, undeclared variables,
+// empty keyTags, unknown logDecisions, mode, merge or capabilities values and missing logFile directories
+// it returns every issue found, in document order
+func Validate(data []byte) []Issue {
+	return ValidateFormat(data, FormatYAML)
+}
+
+// ValidateFormat checks the data of a config file in format : yaml, json or toml, as Validate does
+func ValidateFormat(data []byte, format string) []Issue {
+	return ValidateLayer(data, format, nil)
+}
+
+// ValidateLayer checks the data of a config file merged with other files, as ValidateFormat does
+// variables are the params and variables declared by the other files, usable as ${name} in this one
+func ValidateLayer(data []byte, format string, variables []string) []Issue {
+	doc, err := decodeNode(data, format)
+	if err != nil {
+		return []Issue{{Msg: err.Error()}}
+	}
+	v := &configValidator{declared: declaredVariables(variables)}
+	if len(doc.Content) > 0 {
+		declareNodeVariables(doc.Content[0], v.declared)
+		v.walk(doc.Content[0], configType, "")
+	}
+	return v.issues
+}
+
+// declareNodeVariables adds the names of the params and variables declared by the config node,
+// globally, in a profile or in a keyTag
+func declareNodeVariables(node *yaml.Node, declared map[string]bool) {
+	declare := func(config *yaml.Node) {
+		for _, key := range []string{"params", "variables"} {
+			if names := yamlnode.MappingValue(config, key); names != nil && names.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(names.Content); i += 2 {
+					declared[names.Content[i].Value] = true
+				}
+			}
+		}
+	}
+	declare(node)
+	for _, key := range []string{"profiles", "keyTags"} {
+		if fragments := yamlnode.MappingValue(node, key); fragments != nil && fragments.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(fragments.Content); i += 2 {
+				declare(fragments.Content[i+1])
+			}
+		}
+	}
+}
+
+// add records an issue at the node position
+func (v *configValidator) add(node *yaml.Node, msg string, args ...interface{}) {
+	v.issues = append(v.issues, Issue{Line: node.Line, Column: node.Column, Msg: fmt.Sprintf(msg, args...)})
+}
+
+// walk checks that node matches the type t, path is the position of the node in the config for messages
+func (v *configValidator) walk(node *yaml.Node, t reflect.Type, path string) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if t.Kind() == reflect.Ptr {
+		if node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null" {
+			return
+		}
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			v.add(node, "`%s` must be a mapping", path)
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fields[key.Value]
+			if !ok {
+				if known := closestKey(key.Value, fields); known != "" {
+					v.add(key, "unknown key `%s`, did you mean `%s` ?", yamlnode.JoinPath(path, key.Value), known)
+				} else {
+					v.add(key, "unknown key `%s`", yamlnode.JoinPath(path, key.Value))
+				}
+				continue
+			}
+			v.walk(value, field.Type, yamlnode.JoinPath(path, key.Value))
+			v.checkField(t, key.Value, value, yamlnode.JoinPath(path, key.Value))
+			if contains(interpolatedFields[t], key.Value) {
+				v.checkVariables(key.Value, value, yamlnode.JoinPath(path, key.Value))
+			}
+		}
+		if t == cmdType {
+			v.checkCmd(node, path)
+		}
+		if t == paramType && yamlnode.MappingValue(node, "pattern") == nil && yamlnode.MappingValue(node, "values") == nil {
+			v.add(node, "`%s` must have a pattern or values", path)
+		}
+		if t == certType && yamlnode.MappingValue(node, "ca") == nil {
+			v.add(node, "`%s` must have a ca", path)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			v.add(node, "`%s` must be a mapping", path)
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.walk(node.Content[i+1], t.Elem(), yamlnode.JoinPath(path, node.Content[i].Value))
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			v.add(node, "`%s` must be a list", path)
+			return
+		}
+		for i, item := range node.Content {
+			// a null item, e.g. an empty list item, is not skipped as an unset pointer field is
+			if t.Elem().Kind() == reflect.Ptr && item.Kind == yaml.ScalarNode && item.ShortTag() == "!!null" {
+				v.add(item, "`%s[%d]` is empty", path, i)
+				continue
+			}
+			v.walk(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Bool:
+		var b bool
+		if node.Kind != yaml.ScalarNode || node.Decode(&b) != nil {
+			v.add(node, "`%s` must be a boolean", path)
+		}
+	case reflect.Int:
+		var i int
+		if node.Kind != yaml.ScalarNode || node.Decode(&i) != nil {
+			v.add(node, "`%s` must be an integer", path)
+		}
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			v.add(node, "`%s` must be a string", path)
+		}
+	}
+}
+
+// checkField applies the rules specific to a field of the struct type t
+func (v *configValidator) checkField(t reflect.Type, key string, value *yaml.Node, path string) {
+	switch {
+	case t == configType && key == "allowedCmd" && value.Kind == yaml.SequenceNode:
+		seen := map[string]bool{}
+		for _, item := range value.Content {
+			if command := yamlnode.MappingValue(item, "command"); command != nil && command.Value != "" {
+				if seen[command.Value] {
+					v.add(command, "duplicate command `%s` in `%s`", command.Value, path)
+				}
+				seen[command.Value] = true
+			}
+		}
+	case t == configType && key == "keyTags" && value.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			tagValue := value.Content[i+1]
+			if (tagValue.Kind == yaml.ScalarNode && tagValue.ShortTag() == "!!null") ||
+				(tagValue.Kind == yaml.MappingNode && len(tagValue.Content) == 0) {
+				v.add(value.Content[i], "keyTag `%s` is empty", value.Content[i].Value)
+			}
+		}
+	case t == configType && key == "logFile" && value.Kind == yaml.ScalarNode && value.Value != "":
+		if fileinfo, err := os.Stat(filepath.Dir(value.Value)); err != nil || !fileinfo.IsDir() {
+			v.add(value, "directory of logFile `%s` does not exist", value.Value)
+		}
+	case t == configType && key == "logDecisions" && value.Kind == yaml.ScalarNode:
+		if value.Value != "" && value.Value != "trace" {
+			v.add(value, "`%s` must be trace, got `%s`", path, value.Value)
+		}
+	case t == configType && key == "deniedOutput" && value.Kind == yaml.ScalarNode:
+		if value.Value != "" && value.Value != "stdout" && value.Value != "stderr" {
+			v.add(value, "`%s` must be stdout or stderr, got `%s`", path, value.Value)
+		}
+	case t == configType && (key == "include" && path != "include" || key == "profiles" && path != "profiles" || key == "keys" && path != "keys" ||
+		key == "certificates" && path != "certificates"):
+		v.add(value, "`%s` is only allowed at the top level of a config file", path)
+	case t == configType && key == "extends" && path == "extends":
+		v.add(value, "`%s` is only allowed in a keyTag or a profile", path)
+	case t == configType && key == "capabilities" && value.Kind == yaml.ScalarNode:
+		if value.Value != "" && value.Value != CapabilitiesCommands && value.Value != CapabilitiesArgs {
+			v.add(value, "`%s` must be %s or %s, got `%s`", path, CapabilitiesCommands, CapabilitiesArgs, value.Value)
+		}
+	case t == configType && key == "deniedTemplate" && value.Kind == yaml.ScalarNode:
+		if _, err := parseDeniedTemplate(value.Value); err != nil {
+			v.add(value, "invalid template in `%s` : %s", path, err.Error())
+		}
+	case t == configType && key == "mode" && value.Kind == yaml.ScalarNode:
+		if value.Value != "" && value.Value != "enforce" && value.Value != "learn" {
+			v.add(value, "`%s` must be enforce or learn, got `%s`", path, value.Value)
+		}
+	case (t == configType || t == cmdType) && key == "merge" && value.Kind == yaml.ScalarNode:
+		if value.Value != "" && value.Value != MergeAppend && value.Value != MergeReplace && value.Value != MergeRemove {
+			v.add(value, "`%s` must be %s, %s or %s, got `%s`", path, MergeAppend, MergeReplace, MergeRemove, value.Value)
+		}
+	case t == configType && (key == "params" || key == "variables") && value.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if contains(builtinVariables, value.Content[i].Value) {
+				v.add(value.Content[i], "`%s` can not be named `%s`, set by authcmd", path, value.Content[i].Value)
+			}
+		}
+	case t == configType && key == "exitCodes" && value.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			if !contains(exitCodeKeys, value.Content[i].Value) {
+				v.add(value.Content[i], "unknown exit code `%s`, must be one of %s", value.Content[i].Value, strings.Join(exitCodeKeys, ", "))
+			}
+			var code int
+			if value.Content[i+1].Decode(&code) == nil && (code < 1 || code > 255) {
+				v.add(value.Content[i+1], "exit code `%s` must be between 1 and 255, got `%d`", value.Content[i].Value, code)
+			}
+		}
+	case t == argsType && value.Kind == yaml.SequenceNode, t == cmdType && key == "mustMatch" && value.Kind == yaml.SequenceNode:
+		for _, item := range value.Content {
+			v.checkRegex(item, path)
+		}
+	case t == keyType && key == "key" && value.Kind == yaml.ScalarNode:
+		if _, err := (&Key{Key: value.Value}).Fingerprint(); err != nil {
+			v.add(value, "invalid key in `%s` : %s", path, err.Error())
+		}
+	case t == certType && key == "ca" && value.Kind == yaml.ScalarNode:
+		if err := (&CertRule{CA: value.Value}).check(); err != nil {
+			v.add(value, "invalid rule in `%s` : %s", path, err.Error())
+		}
+	case t == certType && (key == "principal" || key == "keyId"):
+		v.checkRegex(value, path)
+	case t == paramType && key == "pattern":
+		v.checkRegex(value, path)
+	case t == cmdType && key == "replace" && value.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			v.checkRegex(value.Content[i], path)
+		}
+	}
+}
+
+// checkCmd checks that an allowed cmd has a command
+func (v *configValidator) checkCmd(node *yaml.Node, path string) {
+	if command := yamlnode.MappingValue(node, "command"); command == nil || strings.TrimSpace(command.Value) == "" {
+		v.add(node, "`%s` has an empty command", path)
+	}
+}
+
+// interpolatedFields are the fields of each type whose ${name} variables are replaced
+var interpolatedFields = map[reflect.Type][]string{
+	configType: {"setEnvVars", "variables"},
+	cmdType:    {"command", "args", "mustMatch", "replace", "setEnvVars"},
+}
+
+// checkVariables checks that the ${name} variables of the scalars of node are declared
+// the capture groups of the regex of a replace rule can be used in its replacement
+func (v *configValidator) checkVariables(key string, node *yaml.Node, path string) {
+	var check func(node *yaml.Node, path string, except map[string]bool)
+	check = func(node *yaml.Node, path string, except map[string]bool) {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			for _, name := range undeclaredVariables(node.Value, v.declared, except) {
+				v.add(node, "undeclared variable `${%s}` in `%s`", name, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				check(node.Content[i], path, nil)
+				if key == "replace" {
+					check(node.Content[i+1], path, groupNames(node.Content[i].Value))
+				} else {
+					check(node.Content[i+1], yamlnode.JoinPath(path, node.Content[i].Value), nil)
+				}
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				check(item, fmt.Sprintf("%s[%d]", path, i), nil)
+			}
+		}
+	}
+	check(node, path, nil)
+}
+
+// checkRegex checks that a scalar node is a valid regex
+func (v *configValidator) checkRegex(node *yaml.Node, path string) {
+	if node.Kind != yaml.ScalarNode {
+		return
+	}
+	if _, err := regexp.Compile(node.Value); err != nil {
+		v.add(node, "invalid regex `%s` in `%s` : %s", node.Value, path, err.Error())
+	}
+}
+
+// contains returns true if value is in list
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// yamlFields returns the exported fields of the struct type t by yaml key
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for _, field := range reflect.VisibleFields(t) {
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+// closestKey returns the known key at an edit distance of at most 2 from key, ignoring case
+// or an empty string if none
+func closestKey(key string, fields map[string]reflect.StructField) string {
+	closest, closestDistance := "", 3
+	for known := range fields {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(known)); d < closestDistance || (d == closestDistance && known < closest) {
+			closest, closestDistance = known, d
+		}
+	}
+	return closest
+}
+
+// editDistance returns the levenshtein distance between a and b
+func editDistance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// minInt returns the smallest of a and b
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
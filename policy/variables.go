@@ -0,0 +1,357 @@
+package policy
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/sorted"
+)
+
+// Variables set from the request, usable as ${name} in the allowed cmds and setEnvVars
+// TAG is the name of the keyTag defining the value, replaced when the config is loaded
+const (
+	VarUser        = "USER"
+	VarHome        = "HOME"
+	VarTag         = "TAG"
+	VarHostname    = "HOSTNAME"
+	VarSSHClientIP = "SSH_CLIENT_IP"
+)
+
+// builtinVariables are the names of the variables set by authcmd, which can not be params or config variables
+var builtinVariables = []string{VarUser, VarHome, VarTag, VarHostname, VarSSHClientIP}
+
+// variableRegex matches a ${name} variable
+var variableRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// VariableNames returns the sorted names of the params and variables declared by the config,
+// globally, in a profile or in a keyTag
+func (config *Config) VariableNames() []string {
+	seen := map[string]bool{}
+	var names []string
+	add := func(c *Config) {
+		if c == nil {
+			return
+		}
+		for _, name := range append(sortedParams(c.Params), sorted.Keys(c.Variables)...) {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	add(config)
+	for _, fragments := range []map[string]*Config{config.Profiles, config.KeyTags} {
+		for _, name := range sortedNames(fragments) {
+			add(fragments[name])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// declaredVariables returns the names usable as ${name} : the builtin variables and the variable names of the config
+func declaredVariables(names []string) map[string]bool {
+	declared := map[string]bool{}
+	for _, list := range [][]string{builtinVariables, names} {
+		for _, name := range list {
+			declared[name] = true
+		}
+	}
+	return declared
+}
+
+// undeclaredVariables returns the names of the ${name} variables of s which are not declared, nor in except
+func undeclaredVariables(s string, declared map[string]bool, except map[string]bool) []string {
+	var names []string
+	for _, match := range variableRegex.FindAllStringSubmatch(s, -1) {
+		if !declared[match[1]] && !except[match[1]] {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// groupNames returns the names of the capture groups of a regex, used as ${name} in a replacement
+func groupNames(regex string) map[string]bool {
+	names := map[string]bool{}
+	if re, err := regexp.Compile(regex); err == nil {
+		for _, name := range re.SubexpNames() {
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// checkVariables returns an error if the allowed cmds, setEnvVars or variables of the config, its profiles
+// or its keyTags use a ${name} variable which is declared nowhere, as it would be kept as is in a regex
+// a capture group of the regex of a replace rule can be used in its replacement
+func (config *Config) checkVariables(declared map[string]bool) error {
+	var errs []string
+	check := func(prefix, where string, except map[string]bool, list ...string) {
+		for _, s := range list {
+			for _, name := range undeclaredVariables(s, declared, except) {
+				errs = append(errs, fmt.Sprintf("%s%s uses undeclared variable `${%s}`", prefix, where, name))
+			}
+		}
+	}
+	checkMap := func(prefix, where string, m map[string]string) {
+		for _, key := range sorted.Keys(m) {
+			check(prefix, where, nil, key, m[key])
+		}
+	}
+	checkConfig := func(prefix string, c *Config) {
+		checkMap(prefix, "setEnvVars", c.SetEnvVars)
+		for _, name := range sorted.Keys(c.Variables) {
+			check(prefix, fmt.Sprintf("variable `%s`", name), nil, c.Variables[name])
+		}
+		for _, allowedCmd := range c.AllowedCmd {
+			where := fmt.Sprintf("allowedCmd `%s`", allowedCmd.Command)
+			check(prefix, where, nil, allowedCmd.Command)
+			if allowedCmd.Args != nil {
+				check(prefix, where, nil, allowedCmd.Args.Allowed...)
+				check(prefix, where, nil, allowedCmd.Args.Forbidden...)
+			}
+			check(prefix, where, nil, allowedCmd.MustMatch...)
+			for _, search := range sorted.Keys(allowedCmd.Replace) {
+				check(prefix, where, nil, search)
+				check(prefix, where, groupNames(search), allowedCmd.Replace[search])
+			}
+			checkMap(prefix, where, allowedCmd.SetEnvVars)
+		}
+	}
+	checkConfig("", config)
+	for _, kind := range []string{"profile", "keyTag"} {
+		fragments := config.Profiles
+		if kind == "keyTag" {
+			fragments = config.KeyTags
+		}
+		for _, name := range sortedNames(fragments) {
+			if fragments[name] != nil {
+				checkConfig(fmt.Sprintf("%s `%s` ", kind, name), fragments[name])
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// requestVariables returns the values of the builtin variables of the request, except TAG
+// HOME is the HOME of the request env, HOSTNAME the name of the host running authcmd
+// a variable without value is left out
+func requestVariables(req Request) map[string]string {
+	values := map[string]string{}
+	set := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	set(VarUser, req.Client.User)
+	for _, kv := range req.Env {
+		if strings.HasPrefix(kv, VarHome+"=") {
+			set(VarHome, strings.TrimPrefix(kv, VarHome+"="))
+		}
+	}
+	hostname, _ := os.Hostname()
+	set(VarHostname, hostname)
+	set(VarSSHClientIP, req.Client.IP)
+	return values
+}
+
+// interpolate replaces the ${name} variables of s by their value, passed to quote
+// the variables not declared, as the capture groups of a replacement, are kept as is,
+// the names of the declared ones without value are returned
+func interpolate(s string, declared map[string]bool, values map[string]string, quote func(string) string) (string, []string) {
+	var missing []string
+	expanded := variableRegex.ReplaceAllStringFunc(s, func(variable string) string {
+		name := variable[2 : len(variable)-1]
+		if !declared[name] {
+			return variable
+		}
+		value, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			return variable
+		}
+		return quote(value)
+	})
+	return expanded, missing
+}
+
+// literal quotes nothing, for the values used as is
+func literal(s string) string {
+	return s
+}
+
+// replacement quotes a value used in the replacement of a replace rule
+func replacement(s string) string {
+	return strings.ReplaceAll(s, "$", "$$")
+}
+
+// interpolateVariables replaces the declared variables of the allowed cmds, setEnvVars and variables of the config
+// by their value : quoted in the regex of args, mustMatch and replace, as is in the commands and env vars
+// it returns the first missing variable of each allowed cmd, in order, with the ones of the config env vars
+func (config *Config) interpolateVariables(declared map[string]bool, values map[string]string) []string {
+	expandMap := func(m map[string]string, keyQuote, valueQuote func(string) string) (map[string]string, []string) {
+		if m == nil {
+			return nil, nil
+		}
+		var missing []string
+		expanded := make(map[string]string, len(m))
+		for key, value := range m {
+			k, keyMissing := interpolate(key, declared, values, keyQuote)
+			v, valueMissing := interpolate(value, declared, values, valueQuote)
+			missing = append(append(missing, keyMissing...), valueMissing...)
+			expanded[k] = v
+		}
+		return expanded, missing
+	}
+	expandList := func(list []string, quote func(string) string) ([]string, []string) {
+		var missing []string
+		for i, s := range list {
+			var itemMissing []string
+			list[i], itemMissing = interpolate(s, declared, values, quote)
+			missing = append(missing, itemMissing...)
+		}
+		return list, missing
+	}
+	config.Variables, _ = expandMap(config.Variables, literal, literal)
+	var configMissing []string
+	config.SetEnvVars, configMissing = expandMap(config.SetEnvVars, literal, literal)
+
+	cmdsMissing := make([]string, len(config.AllowedCmd))
+	for i, allowedCmd := range config.AllowedCmd {
+		var missing, m []string
+		allowedCmd.Command, missing = interpolate(allowedCmd.Command, declared, values, literal)
+		if allowedCmd.Args != nil {
+			allowedCmd.Args.Allowed, m = expandList(allowedCmd.Args.Allowed, regexp.QuoteMeta)
+			missing = append(missing, m...)
+			allowedCmd.Args.Forbidden, m = expandList(allowedCmd.Args.Forbidden, regexp.QuoteMeta)
+			missing = append(missing, m...)
+		}
+		allowedCmd.MustMatch, m = expandList(allowedCmd.MustMatch, regexp.QuoteMeta)
+		missing = append(missing, m...)
+		allowedCmd.Replace, m = expandMap(allowedCmd.Replace, regexp.QuoteMeta, replacement)
+		missing = append(missing, m...)
+		allowedCmd.SetEnvVars, m = expandMap(allowedCmd.SetEnvVars, literal, literal)
+		missing = append(append(append([]string{}, configMissing...), missing...), m...)
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			cmdsMissing[i] = missing[0]
+		}
+	}
+	return cmdsMissing
+}
+
+// interpolateTag replaces ${TAG} by the name of the keyTag in the config of each keyTag
+func interpolateTag(tags map[string]*Config) {
+	for tag, tagConfig := range tags {
+		if tagConfig != nil {
+			tagConfig.interpolateVariables(map[string]bool{VarTag: true}, map[string]string{VarTag: tag})
+		}
+	}
+}
+
+// WithTag returns a copy of the config with ${TAG} replaced by tag, as in the keyTag tag of a loaded policy
+// and in the profiles it extends
+func (config *Config) WithTag(tag string) *Config {
+	c := config.Clone()
+	interpolateTag(map[string]*Config{tag: c})
+	return c
+}
+
+// usesVariables returns whether the allowed cmds or setEnvVars of the config may use a variable
+func (config *Config) usesVariables() bool {
+	has := func(list ...string) bool {
+		for _, s := range list {
+			if strings.Contains(s, "${") {
+				return true
+			}
+		}
+		return false
+	}
+	hasMap := func(m map[string]string) bool {
+		for key, value := range m {
+			if has(key, value) {
+				return true
+			}
+		}
+		return false
+	}
+	if hasMap(config.SetEnvVars) {
+		return true
+	}
+	for _, allowedCmd := range config.AllowedCmd {
+		if has(allowedCmd.Command) || has(allowedCmd.MustMatch...) || hasMap(allowedCmd.Replace) || hasMap(allowedCmd.SetEnvVars) ||
+			(allowedCmd.Args != nil && (has(allowedCmd.Args.Allowed...) || has(allowedCmd.Args.Forbidden...))) {
+			return true
+		}
+	}
+	return false
+}
+
+// withVariables returns the effective config with the variables of the allowed cmds and setEnvVars replaced
+// by the builtin variables of the request, the params and the config variables, quoted in the regex, and its compiled cmds
+// a denial is returned if a param is not valid, an allowed cmd using a variable without value is denied when matched
+func (e *effective) withVariables(req Request, params map[string]string, tr *Trace) (*effective, *Denial, error) {
+	if len(params) == 0 && len(e.config.Params) == 0 && !e.variables {
+		return e, nil, nil
+	}
+	values, denial := e.config.paramValues(params, tr)
+	if denial != nil {
+		return nil, denial, nil
+	}
+	// a variable declared in another keyTag has no value, the cmds using it are denied
+	declared := e.declared
+	for name, value := range requestVariables(req) {
+		values[name] = value
+	}
+	// the config variables use the builtin variables and the params, not the other config variables
+	var variables map[string]string
+	for _, name := range sorted.Keys(e.config.Variables) {
+		if value, missing := interpolate(e.config.Variables[name], declared, values, literal); len(missing) == 0 {
+			if variables == nil {
+				variables = map[string]string{}
+			}
+			variables[name] = value
+			tr.add(StepParams, "variable `%s` = `%s`", name, value)
+		}
+	}
+	for name, value := range variables {
+		if _, exists := values[name]; !exists {
+			values[name] = value
+		}
+	}
+
+	config := e.config.Clone()
+	cmdsMissing := config.interpolateVariables(declared, values)
+	config.Variables = variables
+	cmds, err := config.compile()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, c := range cmds {
+		c.copyTags(e.cmds[i])
+		c.missing = cmdsMissing[i]
+	}
+	return &effective{config: config, cmds: cmds}, nil, nil
+}
+
+// copyTags sets the keyTags which added the regex of the cmd from the same cmd before interpolation
+func (c *compiledCmd) copyTags(from *compiledCmd) {
+	for i := range c.allowed {
+		c.allowed[i].tag = from.allowed[i].tag
+	}
+	for i := range c.forbidden {
+		c.forbidden[i].tag = from.forbidden[i].tag
+	}
+	for i := range c.mustMatch {
+		c.mustMatch[i].tag = from.mustMatch[i].tag
+	}
+}
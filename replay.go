@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// logLineRegex parses the RUNNING, WARN - Denied and LEARN lines written by handle
+var logLineRegex = regexp.MustCompile("(RUNNING - user|WARN - Denied user|LEARN - Would deny user) `([^`]*)`(?: tags `([^`]*)`)? original (\"(?:[^\"\\\\]|\\\\.)*\")")
+
+// oldLogLineRegex parses the RUNNING lines written before the original command was logged,
+// with only the command run : its resolved path and its args after the replace rules
+var oldLogLineRegex = regexp.MustCompile("RUNNING - user `([^`]*)`(?: tags `([^`]*)`)? command `(.*)`$")
+
+// decisionLineRegex matches every logged decision, the older WARN - Denied lines have no command to replay
+var decisionLineRegex = regexp.MustCompile("(RUNNING - user|WARN - Denied user|LEARN - Would deny user) `")
+
+// A loggedCmd is a command line read from the log with its user, keyTags and decision
+// a learned command was denied but run in learn mode
+type loggedCmd struct {
+	user        string
+	tags        []string
+	originalCmd string
+	allowed     bool
+	learned     bool
+}
+
+// parseLogLine returns the loggedCmd of a log line, false if the line is not a logged decision
+// the command of an older RUNNING line is the command run, as the original command was not logged
+func parseLogLine(line string) (loggedCmd, bool) {
+	splitTags := func(tags string) []string {
+		if tags == "" {
+			return nil
+		}
+		return strings.Split(tags, ",")
+	}
+	m := logLineRegex.FindStringSubmatch(line)
+	if m == nil {
+		if m = oldLogLineRegex.FindStringSubmatch(line); m != nil {
+			return loggedCmd{user: m[1], tags: splitTags(m[2]), originalCmd: m[3], allowed: true}, true
+		}
+		return loggedCmd{}, false
+	}
+	originalCmd, err := strconv.Unquote(m[4])
+	if err != nil {
+		return loggedCmd{}, false
+	}
+	return loggedCmd{user: m[2], tags: splitTags(m[3]), originalCmd: originalCmd, allowed: strings.HasPrefix(m[1], "RUNNING"), learned: strings.HasPrefix(m[1], "LEARN")}, true
+}
+
+// A replayChange is a logged command whose decision changed with the candidate config
+type replayChange struct {
+	loggedCmd
+	count  int
+	reason string
+}
+
+// runReplay implements the replay subcommand
+// It reads the commands logged by handle and evaluates them again with the candidate config,
+// for the logged user and the ip given by --client-ip, not logged, without running anything, and reports the commands whose decision changed
+// Exit code is exitOK if no decision changed, exitFailed if any did
+func runReplay(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("replay", stderr)
+	logFile := fs.String("log", "", "log file written by authcmd")
+	configFile := fs.String("config", "", "candidate config file (default : same lookup as authcmd)")
+	clientIP := fs.String("client-ip", "", "ip of the ssh client, the ${SSH_CLIENT_IP} variable")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 || *logFile == "" {
+		fs.Usage()
+		return exitUsage
+	}
+	f, err := os.Open(*logFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Cannot read log file : %s\n", err.Error())
+		return exitUsage
+	}
+	defer f.Close()
+
+	p, err := loadPolicy(*configFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	changes := map[string]*replayChange{}
+	var order []string
+	replayed, skipped := 0, 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		logged, ok := parseLogLine(scanner.Text())
+		if !ok {
+			if decisionLineRegex.MatchString(scanner.Text()) {
+				skipped++
+			}
+			continue
+		}
+		client := policy.Client{User: logged.user, IP: *clientIP}
+		d, err := p.Evaluate(policy.Request{Command: logged.originalCmd, Tags: logged.tags, Env: os.Environ(), Client: client})
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		replayed++
+		if d.Allowed == logged.allowed {
+			continue
+		}
+		key := fmt.Sprintf("%t\x00%s\x00%s\x00%s", logged.allowed, logged.user, strings.Join(logged.tags, ","), logged.originalCmd)
+		if change, exists := changes[key]; exists {
+			change.count++
+			continue
+		}
+		change := &replayChange{loggedCmd: logged, count: 1}
+		if d.Reason != nil {
+			change.reason = fmt.Sprintf("%s : %s", d.Reason.Code, d.Reason.Error())
+		}
+		changes[key] = change
+		order = append(order, key)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stdout, "Cannot read log file : %s\n", err.Error())
+		return exitUsage
+	}
+
+	sort.SliceStable(order, func(i, j int) bool { return changes[order[i]].allowed && !changes[order[j]].allowed })
+	title := ""
+	for _, key := range order {
+		change := changes[key]
+		if change.allowed && title != "denied" {
+			title = "denied"
+			fmt.Fprintln(stdout, "Previously allowed, now denied :")
+		} else if !change.allowed && title != "allowed" {
+			title = "allowed"
+			fmt.Fprintln(stdout, "Previously denied, now allowed :")
+		}
+		fmt.Fprintf(stdout, "  user `%s` tags `%s` command %q (%d times)\n", change.user, strings.Join(change.tags, ","), change.originalCmd, change.count)
+		if change.reason != "" {
+			fmt.Fprintf(stdout, "    %s\n", change.reason)
+		}
+	}
+	fmt.Fprintf(stdout, "%d commands replayed, %d changed\n", replayed, len(order))
+	if skipped > 0 {
+		fmt.Fprintf(stdout, "%d logged decisions skipped, written without the command line\n", skipped)
+	}
+	if len(order) > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	tt := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "logged user",
+			args: []string{},
+			want: "Previously allowed, now denied :\n" +
+				"  user `deploy` tags `test1` command \"cat LICENSE\" (2 times)\n" +
+				"    COMMAND_NOT_ALLOWED : command `cat` not allowed\n" +
+				"  user `alice` tags `test21` command \"/bin/ping 10.1.2.3\" (1 times)\n" +
+				"    PARAM_INVALID : command `/bin/ping` needs variable `SSH_CLIENT_IP`\n" +
+				"Previously denied, now allowed :\n" +
+				"  user `deploy` tags `test1` command \"/bin/echo \\\"I love pizza\\\"\" (1 times)\n" +
+				"8 commands replayed, 3 changed\n" +
+				"1 logged decisions skipped, written without the command line\n",
+		},
+		{
+			name: "client ip",
+			args: []string{"--client-ip", "10.1.2.3"},
+			want: "Previously allowed, now denied :\n" +
+				"  user `deploy` tags `test1` command \"cat LICENSE\" (2 times)\n" +
+				"    COMMAND_NOT_ALLOWED : command `cat` not allowed\n" +
+				"Previously denied, now allowed :\n" +
+				"  user `deploy` tags `test1` command \"/bin/echo \\\"I love pizza\\\"\" (1 times)\n" +
+				"8 commands replayed, 2 changed\n" +
+				"1 logged decisions skipped, written without the command line\n",
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"--log", "tests/authcmd_replay_test.log", "--config", "tests/authcmd_test.yml"}, tc.args...)
+			if exitCode := runReplay(args, &stdout, &stderr); exitCode != exitFailed {
+				t.Errorf("Want exit code '%d', got '%d'", exitFailed, exitCode)
+			}
+			if stdout.String() != tc.want {
+				t.Errorf("Want '%s', got '%s'", tc.want, stdout.String())
+			}
+		})
+	}
+
+	var stdout, stderr bytes.Buffer
+	if exitCode := runReplay([]string{"--config", "tests/authcmd_test.yml"}, &stdout, &stderr); exitCode != exitUsage {
+		t.Errorf("Want exit code '%d', got '%d'", exitUsage, exitCode)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// runSchema implements the schema subcommand
+// It prints the JSON Schema of the config file, also published as authcmd.schema.json
+func runSchema(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("schema", stderr)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	out, err := json.MarshalIndent(policy.Schema(), "", "  ")
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+	fmt.Fprintln(stdout, string(out))
+	return exitOK
+}
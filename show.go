@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/yamlnode"
+	"github.com/dranih/authcmd/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// An effectivePolicy is the config merged with a list of keyTags
+// with the origin of each value by path, as printed by the show subcommand
+type effectivePolicy struct {
+	Tags    []string          `json:"tags"`
+	Config  *policy.Config    `json:"config"`
+	Origins map[string]string `json:"origins"`
+}
+
+// newEffectivePolicy returns the config of the policy merged with the tags and the origin of its values
+func newEffectivePolicy(p *policy.Policy, tags []string) (*effectivePolicy, error) {
+	merged, err := p.Effective(tags)
+	if err != nil {
+		return nil, err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	origins := configOrigins(p.Sources(), tags)
+	// the values removed by a later config are dropped
+	present := map[string]bool{}
+	var node yaml.Node
+	if err := node.Encode(merged); err == nil {
+		walkConfigPaths(&node, "", func(path string, _ *yaml.Node, _ bool) { present[path] = true })
+	}
+	for path := range origins {
+		if !present[path] {
+			delete(origins, path)
+		}
+	}
+	return &effectivePolicy{Tags: tags, Config: merged, Origins: origins}, nil
+}
+
+// configOrigins returns the origin of every value of the config files merged with the tags, by path
+// a value is from the base config or from the last keyTag, or profile extended by a keyTag, setting it
+// with several config files, the origin names the last file setting the value
+// the origins of values removed by a later config are left for the caller to drop
+func configOrigins(sources []policy.Source, tags []string) map[string]string {
+	origins := map[string]string{}
+	record := func(c *policy.Config, origin string) {
+		// a removed or replaced cmd loses the origins of its values
+		for path := range origins {
+			for _, allowedCmd := range c.AllowedCmd {
+				if (allowedCmd.Merge == policy.MergeReplace || (allowedCmd.Merge == "" && c.Merge == policy.MergeReplace)) &&
+					strings.HasPrefix(path, "allowedCmd["+allowedCmd.Command+"]") {
+					delete(origins, path)
+				}
+			}
+			for _, command := range c.RemoveCmd {
+				if strings.HasPrefix(path, "allowedCmd["+command+"]") {
+					delete(origins, path)
+				}
+			}
+		}
+		var node yaml.Node
+		if err := node.Encode(c); err != nil {
+			return
+		}
+		walkConfigPaths(&node, "", func(path string, _ *yaml.Node, identity bool) {
+			// an existing cmd is merged, it keeps its origin
+			if _, exists := origins[path]; !identity || !exists {
+				origins[path] = origin
+			}
+		})
+	}
+	layered := len(sources) > 1
+	for _, source := range sources {
+		baseOnly := *source.Config
+		baseOnly.KeyTags = nil
+		baseOnly.Include = nil
+		baseOnly.Profiles = nil
+		if layered {
+			record(&baseOnly, "file `"+source.File+"`")
+		} else {
+			record(&baseOnly, "base")
+		}
+	}
+	// fragments returns the profiles, or the keyTags, of a config
+	fragments := func(c *policy.Config, kind string) map[string]*policy.Config {
+		if kind == "profile" {
+			return c.Profiles
+		}
+		return c.KeyTags
+	}
+	// recordFragment records a keyTag or a profile after the profiles and keyTags it extends, as they are merged
+	// its values are recorded with ${TAG} replaced by the keyTag tag, as in the effective config
+	var recordFragment func(tag, kind, name string, chain map[string]bool)
+	recordFragment = func(tag, kind, name string, chain map[string]bool) {
+		if chain[kind+name] {
+			return
+		}
+		chain[kind+name] = true
+		defer delete(chain, kind+name)
+		var extends []string
+		for _, source := range sources {
+			if fragment := fragments(source.Config, kind)[name]; fragment != nil {
+				extends = append(extends, fragment.Extends...)
+			}
+		}
+		seen := map[string]bool{}
+		for _, extended := range extends {
+			if seen[extended] {
+				continue
+			}
+			seen[extended] = true
+			extendedKind := "keyTag"
+			for _, source := range sources {
+				if _, exists := source.Config.Profiles[extended]; exists {
+					extendedKind = "profile"
+				}
+			}
+			recordFragment(tag, extendedKind, extended, chain)
+		}
+		for _, source := range sources {
+			if fragment := fragments(source.Config, kind)[name]; fragment != nil {
+				if layered {
+					record(fragment.WithTag(tag), kind+" `"+name+"` of `"+source.File+"`")
+				} else {
+					record(fragment.WithTag(tag), kind+" `"+name+"`")
+				}
+			}
+		}
+	}
+	for _, tag := range tags {
+		recordFragment(tag, "keyTag", tag, map[string]bool{})
+	}
+	return origins
+}
+
+// walkConfigPaths calls visit for every value node of a config yaml node with its path
+// list items are identified by their value, or their command for allowed cmds (identity is then true)
+// e.g. showDenied, setEnvVars.MY_VAR, allowedCmd[ls], allowedCmd[ls].args.allowed[-l]
+func walkConfigPaths(node *yaml.Node, path string, visit func(path string, node *yaml.Node, identity bool)) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			walkConfigPaths(child, path, visit)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if path == "" && key.Value == "keyTags" {
+				continue
+			}
+			if key.Value == "command" && value.Kind == yaml.ScalarNode && path != "" {
+				visit(path, value, true)
+				continue
+			}
+			walkConfigPaths(value, yamlnode.JoinPath(path, key.Value), visit)
+		}
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			id := item.Value
+			if command := yamlnode.MappingValue(item, "command"); command != nil {
+				id = command.Value
+			}
+			walkConfigPaths(item, fmt.Sprintf("%s[%s]", path, id), visit)
+		}
+	case yaml.ScalarNode:
+		visit(path, node, false)
+	}
+}
+
+// yaml returns the effective policy as a yaml document, each value commented with its origin
+func (p *effectivePolicy) yaml() (string, error) {
+	var node yaml.Node
+	if err := node.Encode(p.Config); err != nil {
+		return "", err
+	}
+	walkConfigPaths(&node, "", func(path string, value *yaml.Node, _ bool) {
+		if origin, ok := p.Origins[path]; ok {
+			value.LineComment = "from " + origin
+		}
+	})
+	var sb strings.Builder
+	enc := yaml.NewEncoder(&sb)
+	enc.SetIndent(2)
+	err := enc.Encode(&node)
+	return sb.String(), err
+}
+
+// runShow implements the show subcommand
+// It prints the config merged with the keyTags as handle would use it, in yaml or json,
+// with the origin of each value. With --all-tags, the policy of each keyTag is printed
+func runShow(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("show", stderr)
+	configFile := fs.String("config", "", "config file (default : same lookup as authcmd)")
+	var tags tagsFlag
+	fs.Var(&tags, "tags", "comma separated keyTags, as passed to authcmd in authorized_keys")
+	allTags := fs.Bool("all-tags", false, "print the effective policy of every keyTag")
+	format := fs.String("format", "yaml", "output format : yaml or json")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 || (*format != "yaml" && *format != "json") || (*allTags && len(tags) > 0) {
+		fs.Usage()
+		return exitUsage
+	}
+
+	p, err := loadPolicy(*configFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	tagLists := [][]string{tags}
+	if *allTags {
+		tagLists = nil
+		for _, tag := range p.Base().Tags() {
+			tagLists = append(tagLists, []string{tag})
+		}
+	}
+
+	var policies []*effectivePolicy
+	for _, tagList := range tagLists {
+		ep, err := newEffectivePolicy(p, tagList)
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		policies = append(policies, ep)
+	}
+
+	if *format == "json" {
+		var v interface{} = policies
+		if !*allTags {
+			v = policies[0]
+		}
+		out, _ := json.MarshalIndent(v, "", "  ")
+		fmt.Fprintln(stdout, string(out))
+		return exitOK
+	}
+	for i, ep := range policies {
+		out, err := ep.yaml()
+		if err != nil {
+			fmt.Fprintln(stderr, err.Error())
+			return exitFailed
+		}
+		if *allTags {
+			if i > 0 {
+				fmt.Fprintln(stdout, "---")
+			}
+			fmt.Fprintf(stdout, "# keyTag `%s`\n", ep.Tags[0])
+		}
+		fmt.Fprint(stdout, out)
+	}
+	return exitOK
+}
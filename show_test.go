@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestShow(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if exitCode := runShow([]string{"--config", "tests/authcmd_test.yml", "--tags", "test1,test10"}, &stdout, &stderr); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d' : %s", exitOK, exitCode, stdout.String())
+	}
+	want := `showDenied: true # from keyTag ` + "`test1`" + `
+expandEnvVars: true # from keyTag ` + "`test10`" + `
+allowedCmd:
+  - command: ls # from base
+    args:
+      allowed:
+        - -l # from keyTag ` + "`test1`" + `
+        - .*go # from keyTag ` + "`test1`" + `
+  - command: id # from keyTag ` + "`test1`" + `
+  - command: /bin/echo # from keyTag ` + "`test1`" + `
+    args:
+      forbidden:
+        - \$ # from keyTag ` + "`test1`" + `
+    replace:
+      I: We # from keyTag ` + "`test1`" + `
+      pizza$: pasta # from keyTag ` + "`test1`" + `
+  - command: echo # from keyTag ` + "`test10`" + `
+    setEnvVars:
+      MY_VAR: test10 echo cmd # from keyTag ` + "`test10`" + `
+`
+	if stdout.String() != want {
+		t.Errorf("Want '%s', got '%s'", want, stdout.String())
+	}
+
+	stdout.Reset()
+	if exitCode := runShow([]string{"--config", "tests/authcmd_test.yml", "--all-tags", "--format", "json"}, &stdout, &stderr); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d' : %s", exitOK, exitCode, stdout.String())
+	}
+	var policies []*effectivePolicy
+	if err := json.Unmarshal(stdout.Bytes(), &policies); err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 21 || strings.Join(policies[0].Tags, ",") != "test1" {
+		t.Fatalf("Want the 21 keyTags policies, got %d", len(policies))
+	}
+	if origin := policies[2].Origins["setEnvVars.MY_VAR"]; origin != "keyTag `test11`" {
+		t.Errorf("Want setEnvVars.MY_VAR from keyTag `test11`, got '%s'", origin)
+	}
+
+	if origin := policies[10].Origins["allowedCmd[cat].args.forbidden[^/etc]"]; origin != "profile `readonly`" {
+		t.Errorf("Want allowedCmd[cat].args.forbidden[^/etc] from profile `readonly`, got '%s'", origin)
+	}
+
+	// the origins are kept for the values where ${TAG} is replaced
+	stdout.Reset()
+	if exitCode := runShow([]string{"--config", "tests/authcmd_show_tag_test.yml", "--tags", "ops"}, &stdout, &stderr); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d' : %s", exitOK, exitCode, stdout.String())
+	}
+	want = `allowedCmd:
+  - command: /bin/cat # from profile ` + "`own`" + `
+    args:
+      allowed:
+        - ^/srv/ops/ # from profile ` + "`own`" + `
+  - command: /usr/bin/tag-ops # from keyTag ` + "`ops`" + `
+`
+	if stdout.String() != want {
+		t.Errorf("Want '%s', got '%s'", want, stdout.String())
+	}
+
+	if exitCode := runShow([]string{"--all-tags", "--tags", "test1"}, &stdout, &stderr); exitCode != exitUsage {
+		t.Errorf("Want exit code '%d', got '%d'", exitUsage, exitCode)
+	}
+}
+
+func TestShowLayers(t *testing.T) {
+	defer func(file string) { systemConfigFile = file }(systemConfigFile)
+	systemConfigFile = "tests/layers/system/authcmd.yml"
+	var stdout, stderr bytes.Buffer
+	if exitCode := runShow([]string{"--config", "tests/layers/user/authcmd.yml", "--tags", "ops,dev"}, &stdout, &stderr); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d' : %s", exitOK, exitCode, stdout.String()+stderr.String())
+	}
+	for _, want := range []string{
+		"showDenied: true # from keyTag `ops` of `tests/layers/user/authcmd.yml`\n",
+		"enableLogging: false # from file `tests/layers/system/authcmd.yml`\n",
+		"  - command: id # from file `tests/layers/system/authcmd.yml`\n",
+		"  - command: /bin/echo # from file `tests/layers/user/common/echo.yml`\n",
+		"        - ^-a$ # from keyTag `ops` of `tests/layers/user/authcmd.d/10-ops.toml`\n",
+		"  - command: uptime # from keyTag `ops` of `tests/layers/system/authcmd.yml`\n",
+		"  - command: git # from keyTag `dev` of `tests/layers/user/authcmd.d/20-dev.json`\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("Want '%s', got '%s'", want, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/dranih/authcmd/internal/sorted"
+	"github.com/dranih/authcmd/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// A policyTests is a policy test suite file run by the test subcommand
+type policyTests struct {
+	Config string        `yaml:"config"`
+	Tests  []*policyTest `yaml:"tests"`
+}
+
+// A policyTest is a test case of a policy test suite
+// User and ClientIP override the ones of the flags of the test subcommand
+// Expect is allow or deny, Argv, Code and Message are checked only if set
+type policyTest struct {
+	Name     string            `yaml:"name"`
+	Command  string            `yaml:"command"`
+	Tags     []string          `yaml:"tags"`
+	Env      map[string]string `yaml:"env"`
+	User     string            `yaml:"user"`
+	ClientIP string            `yaml:"clientIp"`
+	Expect   string            `yaml:"expect"`
+	Argv     []string          `yaml:"argv"`
+	Code     string            `yaml:"code"`
+	Message  string            `yaml:"message"`
+}
+
+// runTest implements the test subcommand
+// It loads a policy test suite and evaluates every test case without running anything
+// The config is the one given by --config, or the config key of the suite (relative to the suite file)
+// or found by findConfigFile
+// Exit code is exitOK if all tests pass, exitFailed if any fails
+func runTest(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("test", stderr)
+	configFile := fs.String("config", "", "config file (default : config of the test file or same lookup as authcmd)")
+	var client clientFlags
+	client.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	testsFile := fs.Arg(0)
+	suite := &policyTests{}
+	yfile, err := ioutil.ReadFile(testsFile)
+	if err == nil {
+		// a misspelled key, like `expected`, would silently skip its check
+		dec := yaml.NewDecoder(bytes.NewReader(yfile))
+		dec.KnownFields(true)
+		if err = dec.Decode(suite); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "Cannot read test file `%s` got error `%s`\n", testsFile, err.Error())
+		return exitUsage
+	}
+	if *configFile == "" && suite.Config != "" {
+		*configFile = suite.Config
+		if !filepath.IsAbs(*configFile) {
+			*configFile = filepath.Join(filepath.Dir(testsFile), *configFile)
+		}
+	}
+
+	p, err := loadPolicy(*configFile)
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	failed := 0
+	for i, tc := range suite.Tests {
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d `%s`", i+1, tc.Command)
+		}
+		diffs, err := tc.run(p, client.client())
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		if len(diffs) == 0 {
+			fmt.Fprintf(stdout, "PASS %s\n", name)
+			continue
+		}
+		failed++
+		fmt.Fprintf(stdout, "FAIL %s\n", name)
+		for _, diff := range diffs {
+			fmt.Fprintf(stdout, "    %s\n", diff)
+		}
+	}
+	fmt.Fprintf(stdout, "%d passed, %d failed\n", len(suite.Tests)-failed, failed)
+	if failed > 0 {
+		return exitFailed
+	}
+	return exitOK
+}
+
+// run evaluates the test case against the policy for the ssh client, with the user and ip of the test case if set
+// the command env is only the env of the test case
+// it returns the differences with the expected result
+func (tc *policyTest) run(p *policy.Policy, client policy.Client) ([]string, error) {
+	var environ []string
+	for _, key := range sorted.Keys(tc.Env) {
+		environ = append(environ, key+"="+tc.Env[key])
+	}
+	if tc.User != "" {
+		client.User = tc.User
+	}
+	if tc.ClientIP != "" {
+		client.IP = tc.ClientIP
+	}
+	d, err := p.Evaluate(policy.Request{Command: tc.Command, Tags: tc.Tags, Env: environ, Client: client})
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []string
+	got := "allow"
+	if !d.Allowed {
+		got = "deny"
+	}
+	if tc.Expect != "allow" && tc.Expect != "deny" {
+		diffs = append(diffs, fmt.Sprintf("expect : must be allow or deny, got `%s`", tc.Expect))
+	} else if tc.Expect != got {
+		diffs = append(diffs, fmt.Sprintf("decision : want %s, got %s", tc.Expect, got))
+		if d.Reason != nil {
+			diffs = append(diffs, fmt.Sprintf("reason : %s : %s", d.Reason.Code, d.Reason.Error()))
+		}
+	}
+	if tc.Argv != nil && d.Allowed && strings.Join(tc.Argv, "\x00") != strings.Join(d.Argv, "\x00") {
+		diffs = append(diffs, fmt.Sprintf("argv : want %q, got %q", tc.Argv, d.Argv))
+	}
+	if tc.Code != "" && !d.Allowed && tc.Code != string(d.Reason.Code) {
+		diffs = append(diffs, fmt.Sprintf("code : want %s, got %s", tc.Code, d.Reason.Code))
+	}
+	if tc.Message != "" && !d.Allowed && tc.Message != d.Reason.Error() {
+		diffs = append(diffs, fmt.Sprintf("message : want `%s`, got `%s`", tc.Message, d.Reason.Error()))
+	}
+	return diffs, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestPolicyTests(t *testing.T) {
+	tt := []struct {
+		name      string
+		args      []string
+		wantRegex string
+		exitCode  int
+	}{
+		{
+			name:      "passing",
+			args:      []string{"tests/policy_tests.yml"},
+			wantRegex: "(?s)^PASS ls allowed for all\n.*PASS ip of the client\n7 passed, 0 failed\n$",
+			exitCode:  exitOK,
+		},
+		{
+			name: "failing",
+			args: []string{"tests/policy_tests_failing.yml"},
+			wantRegex: "(?s)^FAIL rm allowed\n    decision : want allow, got deny\n    reason : COMMAND_NOT_ALLOWED : command `rm` not allowed\n" +
+				"FAIL #2 `ls -l`\n    argv : want \\[\"ls\" \"-a\"\\], got \\[\"ls\" \"-l\"\\]\n" +
+				"FAIL wrong message\n    code : want ARG_FORBIDDEN, got COMMAND_NOT_ALLOWED\n    message : want `nope`, got `command `id` not allowed`\n" +
+				"FAIL no client ip\n    decision : want allow, got deny\n    reason : PARAM_INVALID : command `/bin/ping` needs variable `SSH_CLIENT_IP`\n0 passed, 4 failed\n$",
+			exitCode: exitFailed,
+		},
+		{
+			name:      "client flags",
+			args:      []string{"--user", "bob", "--client-ip", "10.1.2.3", "tests/policy_tests_failing.yml"},
+			wantRegex: "(?s)^FAIL rm allowed\n.*PASS no client ip\n1 passed, 3 failed\n$",
+			exitCode:  exitFailed,
+		},
+		{
+			name:      "config override",
+			args:      []string{"--config", "tests/authcmd_invalid_regex_test.yml", "tests/policy_tests.yml"},
+			wantRegex: "^Config error : invalid config file",
+			exitCode:  exitConfigError,
+		},
+		{
+			name:      "unknown key",
+			args:      []string{"tests/policy_tests_unknown_key.yml"},
+			wantRegex: "^Cannot read test file `tests/policy_tests_unknown_key.yml` got error `yaml: unmarshal errors:\n  line 6: field expected not found in type main.policyTest`\n$",
+			exitCode:  exitUsage,
+		},
+		{
+			name:     "no test file",
+			args:     []string{},
+			exitCode: exitUsage,
+		},
+	}
+	os.Unsetenv("SSH_ORIGINAL_COMMAND")
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode, _ := runCommand(append([]string{"test"}, tc.args...), &stdout, &stderr)
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d' with output '%s'", tc.exitCode, exitCode, stdout.String()+stderr.String())
+			}
+			if tc.wantRegex != "" && !regexp.MustCompile(tc.wantRegex).MatchString(stdout.String()) {
+				t.Errorf("Regex '%s' not matching, got '%s'", tc.wantRegex, stdout.String())
+			}
+		})
+	}
+}
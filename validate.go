@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/dranih/authcmd/policy"
+)
+
+// runValidate implements the validate subcommand
+// It checks strictly every file of the config layers (system file, config file, included and drop-in files)
+// and prints every issue with its position
+// Exit code is exitOK if the config is valid, exitConfigError if not
+func runValidate(args []string, stdout, stderr io.Writer) int {
+	fs := newFlagSet("validate", stderr)
+	configFile := fs.String("config", "", "config file (default : same lookup as authcmd)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	layers, err := configLayers(*configFile)
+	var files []policy.Layer
+	for _, layer := range layers {
+		var layerFiles []policy.Layer
+		if layerFiles, err = policy.LayerFiles(layer); err != nil {
+			break
+		}
+		files = append(files, layerFiles...)
+	}
+	if err != nil {
+		fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+		return exitConfigError
+	}
+	// a file can use the params and variables declared by the other files
+	datas := make([][]byte, 0, len(files))
+	var variables []string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file.File)
+		if err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+		datas = append(datas, data)
+		config := &policy.Config{}
+		if policy.Unmarshal(data, file.Format, config) == nil {
+			variables = append(variables, config.VariableNames()...)
+		}
+	}
+	exitCode := exitOK
+	for i, file := range files {
+		issues := policy.ValidateLayer(datas[i], file.Format, variables)
+		for _, issue := range issues {
+			if issue.Line > 0 {
+				fmt.Fprintf(stdout, "%s:%d:%d: %s\n", file.File, issue.Line, issue.Column, issue.Msg)
+			} else {
+				fmt.Fprintf(stdout, "%s: %s\n", file.File, issue.Msg)
+			}
+		}
+		if len(issues) > 0 {
+			exitCode = exitConfigError
+		} else {
+			fmt.Fprintf(stdout, "%s : valid\n", file.File)
+		}
+	}
+	// the extends of the keyTags are resolved once the files are merged
+	if exitCode == exitOK {
+		if _, err := policy.LoadLayers(layers...); err != nil {
+			fmt.Fprintf(stdout, "Config error : %s\n", err.Error())
+			return exitConfigError
+		}
+	}
+	return exitCode
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tt := []struct {
+		name     string
+		args     []string
+		want     []string
+		exitCode int
+	}{
+		{
+			name:     "valid",
+			args:     []string{"--config", "tests/authcmd_test.yml"},
+			want:     []string{"tests/authcmd_test.yml : valid"},
+			exitCode: exitOK,
+		},
+		{
+			name: "layers",
+			args: []string{"--config", "tests/layers/user/authcmd.yml"},
+			want: []string{
+				"tests/layers/user/authcmd.yml : valid",
+				"tests/layers/user/common/echo.yml : valid",
+				"tests/layers/user/authcmd.d/10-ops.toml : valid",
+				"tests/layers/user/authcmd.d/20-dev.json : valid",
+			},
+			exitCode: exitOK,
+		},
+		{
+			name: "invalid",
+			args: []string{"--config", "tests/authcmd_invalid_test.yml"},
+			want: []string{
+				"tests/authcmd_invalid_test.yml:4:10: directory of logFile `/does/not/exist/authcmd.log` does not exist",
+				"tests/authcmd_invalid_test.yml:5:15: `logDecisions` must be trace, got `verbose`",
+				"tests/authcmd_invalid_test.yml:7:1: unknown key `allowedCmds`, did you mean `allowedCmd` ?",
+				"tests/authcmd_invalid_test.yml:12:5: unknown key `allowedCmd[0].mustmatch`, did you mean `mustMatch` ?",
+				"tests/authcmd_invalid_test.yml:14:5: `allowedCmd[2]` has an empty command",
+				"tests/authcmd_invalid_test.yml:17:7: unknown key `allowedCmd[3].args.forbiden`, did you mean `forbidden` ?",
+				"tests/authcmd_invalid_test.yml:18:16: `allowedCmd[3].args.allowed` must be a list",
+				"tests/authcmd_invalid_test.yml:19:15: invalid regex `(` in `allowedCmd[3].replace` : error parsing regexp: missing closing ): `(`",
+				"tests/authcmd_invalid_test.yml:20:4: `allowedCmd[4]` is empty",
+				"tests/authcmd_invalid_test.yml:13:14: duplicate command `ls` in `allowedCmd`",
+				"tests/authcmd_invalid_test.yml:25:18: `keyTags.test1.showAllowed` must be a boolean",
+				"tests/authcmd_invalid_test.yml:30:22: `keyTags.test2.exitCodes.ARG_FORBIDDEN` must be an integer",
+				"tests/authcmd_invalid_test.yml:28:7: unknown exit code `DENYED`, must be one of DENIED, CONFIG_ERROR, INTERNAL_ERROR, NO_COMMAND, COMMAND_NOT_ALLOWED, ARG_FORBIDDEN, ARG_NOT_ALLOWED, MUST_MATCH_FAILED, PARSE_ERROR, SHELL_NOT_FOUND, PARAM_INVALID",
+				"tests/authcmd_invalid_test.yml:29:15: exit code `DENIED` must be between 1 and 255, got `0`",
+				"tests/authcmd_invalid_test.yml:31:19: `keyTags.test2.deniedOutput` must be stdout or stderr, got `stdin`",
+				"tests/authcmd_invalid_test.yml:32:21: invalid template in `keyTags.test2.deniedTemplate` : template: deniedTemplate:1: unclosed action",
+				"tests/authcmd_invalid_test.yml:33:19: `keyTags.test2.capabilities` must be commands or args, got `all`",
+				"tests/authcmd_invalid_test.yml:34:12: `keyTags.test2.merge` must be append, replace or remove, got `prepend`",
+				"tests/authcmd_invalid_test.yml:36:16: `keyTags.test2.params.project` must have a pattern or values",
+				"tests/authcmd_invalid_test.yml:38:7: `keyTags.test2.variables` can not be named `USER`, set by authcmd",
+				"tests/authcmd_invalid_test.yml:39:18: invalid key in `keyTags.test2.keys[0].key` : `nope` is neither a SHA256 fingerprint nor a public key `type base64 [comment]`",
+				"tests/authcmd_invalid_test.yml:39:11: `keyTags.test2.keys` is only allowed at the top level of a config file",
+				"tests/authcmd_invalid_test.yml:40:25: invalid rule in `keyTags.test2.certificates[0].ca` : ca `SHA256:x` is not a SHA256 fingerprint",
+				"tests/authcmd_invalid_test.yml:40:46: invalid regex `(` in `keyTags.test2.certificates[0].principal` : error parsing regexp: missing closing ): `(`",
+				"tests/authcmd_invalid_test.yml:40:52: `keyTags.test2.certificates[1]` must have a ca",
+				"tests/authcmd_invalid_test.yml:40:19: `keyTags.test2.certificates` is only allowed at the top level of a config file",
+				"tests/authcmd_invalid_test.yml:23:3: keyTag `empty` is empty",
+			},
+			exitCode: exitConfigError,
+		},
+		{
+			name: "invalid json",
+			args: []string{"--config", "tests/authcmd_invalid_test.json"},
+			want: []string{
+				"tests/authcmd_invalid_test.json: unknown key `allowedCmd[0].mustmatch`, did you mean `mustMatch` ?",
+				"tests/authcmd_invalid_test.json: invalid regex `(` in `allowedCmd[1].args.allowed` : error parsing regexp: missing closing ): `(`",
+				"tests/authcmd_invalid_test.json: `showDenied` must be a boolean",
+			},
+			exitCode: exitConfigError,
+		},
+		{
+			name: "invalid toml",
+			args: []string{"--config", "tests/authcmd_invalid_test.toml"},
+			want: []string{
+				"tests/authcmd_invalid_test.toml: unknown key `allowedCmd[0].mustmatch`, did you mean `mustMatch` ?",
+				"tests/authcmd_invalid_test.toml: invalid regex `(` in `allowedCmd[1].args.allowed` : error parsing regexp: missing closing ): `(`",
+				"tests/authcmd_invalid_test.toml: exit code `DENIED` must be between 1 and 255, got `0`",
+				"tests/authcmd_invalid_test.toml: `showDenied` must be a boolean",
+			},
+			exitCode: exitConfigError,
+		},
+		{
+			name: "extends cycle",
+			args: []string{"--config", "tests/authcmd_extends_cycle_test.yml"},
+			want: []string{
+				"tests/authcmd_extends_cycle_test.yml : valid",
+				"Config error : invalid config file `tests/authcmd_extends_cycle_test.yml` : extends cycle : `ops` -> `readonly` -> `ops`",
+			},
+			exitCode: exitConfigError,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			exitCode := runValidate(tc.args, &stdout, &stderr)
+			if exitCode != tc.exitCode {
+				t.Errorf("Want exit code '%d', got '%d'", tc.exitCode, exitCode)
+			}
+			if got := strings.TrimSpace(stdout.String()); got != strings.Join(tc.want, "\n") {
+				t.Errorf("Want '%s', got '%s'", strings.Join(tc.want, "\n"), got)
+			}
+		})
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	os.Setenv("AUTHCMD_CONFIG_FILE", "tests/authcmd_invalid_test.yml")
+	os.Setenv("SSH_ORIGINAL_COMMAND", "ls")
+	os.Args = os.Args[:1]
+	exitCode, out := handle()
+	if exitCode != 78 || !strings.Contains(out, "line 7 column 1 : unknown key `allowedCmds`") {
+		t.Errorf("Want strict config refused, got '%d' '%s'", exitCode, out)
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	// a toml config with an extension not telling its format
+	configFile := filepath.Join(t.TempDir(), "authcmd.conf")
+	if err := ioutil.WriteFile(configFile, []byte("[[allowedCmd]]\ncommand = \"/bin/echo\"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("AUTHCMD_CONFIG_FILE", configFile)
+	os.Setenv("SSH_ORIGINAL_COMMAND", "/bin/echo toml")
+	defer os.Unsetenv("AUTHCMD_CONFIG_FORMAT")
+	os.Args = os.Args[:1]
+	if exitCode, _ := handle(); exitCode != 78 {
+		t.Errorf("Want the toml config refused as yaml, got '%d'", exitCode)
+	}
+	os.Setenv("AUTHCMD_CONFIG_FORMAT", "toml")
+	if exitCode, out := handle(); exitCode != 0 || strings.TrimSpace(out) != "toml" {
+		t.Errorf("Want the toml config loaded with AUTHCMD_CONFIG_FORMAT, got '%d' '%s'", exitCode, out)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if exitCode := runSchema(nil, &stdout, &stderr); exitCode != exitOK {
+		t.Fatalf("Want exit code '%d', got '%d'", exitOK, exitCode)
+	}
+	published, err := ioutil.ReadFile("authcmd.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != string(published) {
+		t.Errorf("authcmd.schema.json is not up to date, run : authcmd schema > authcmd.schema.json")
+	}
+}